@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -16,7 +17,9 @@ import (
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/burkemw3/syncthingfuse/lib/config"
 	"github.com/burkemw3/syncthingfuse/lib/model"
+	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/thejerf/suture"
 	"golang.org/x/net/context"
 )
@@ -27,74 +30,163 @@ var Usage = func() {
 	flag.PrintDefaults()
 }
 
-func MountFuse(mountpoint string, m *model.Model, mainSvc suture.Service) {
-	c, err := fuse.Mount(
-		mountpoint,
-		fuse.FSName("syncthingfuse"),
-		fuse.Subtype("syncthingfuse"),
-		fuse.LocalVolume(),
-		fuse.VolumeName("Syncthing FUSE"),
-	)
-	if err != nil {
-		l.Warnln(err)
-	}
-
+// MountFuse serves all mounts until a signal arrives, or until all of them
+// are unmounted from outside, then stops everything.
+func MountFuse(cfg *config.Wrapper, m *model.Model, mainSvc *suture.Supervisor) {
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 
-	doneServe := make(chan error, 1)
+	mounts := newFuseMounts(cfg, m)
+	fuseSvc := suture.NewSimple("fuse")
+	for _, mount := range mounts {
+		fuseSvc.Add(mount)
+	}
+	mainSvc.Add(fuseSvc)
+
+	allUnmounted := make(chan struct{})
 	go func() {
-		doneServe <- fs.Serve(c, FS{m: m})
+		for _, mount := range mounts {
+			<-mount.unmounted
+		}
+		close(allUnmounted)
 	}()
 
 	select {
-	case err := <-doneServe:
-		l.Infoln("conn.Serve returned", err)
-
-		// check if the mount process has an error to report
-		<-c.Ready
-		if err := c.MountError; err != nil {
-			l.Warnln("conn.MountError:", err)
-		}
+	case <-allUnmounted:
+		l.Infoln("All mount points unmounted, shutting down.")
 	case sig := <-sigc:
 		l.Infoln("Signal", sig, "received, shutting down.")
 	}
 
+	// stopping the supervisor unmounts each mount point
 	mainSvc.Stop()
-
-	l.Infoln("Unmounting...")
-	err = Unmount(mountpoint)
-	if err == nil {
-		l.Infoln("Unmounted")
-	} else {
-		l.Infoln("Unmount failed:", err)
-	}
 }
 
 var (
 	debugFuse = strings.Contains(os.Getenv("STTRACE"), "fuse") || os.Getenv("STTRACE") == "all"
 )
 
+// The kernel caches attributes and lookups this long. Changes from peers
+// invalidate them right away, so they can be long.
+const (
+	attrValid  = time.Minute
+	entryValid = time.Minute
+)
+
+// invalidate tells the kernel to drop what it cached about files changed by
+// peers. Nodes are compared by value, so rebuilding them finds the ones the
+// kernel knows about.
+func invalidate(srv *fs.Server, m *model.Model, folder string, files []string) {
+	for _, file := range files {
+		if debugFuse {
+			l.Debugln("Invalidating folder", folder, "path", file)
+		}
+
+		nodes := []fs.Node{
+			File{path: file, folder: folder, m: m},
+			Dir{path: file, folder: folder, m: m},
+			Symlink{path: file, folder: folder, m: m},
+		}
+		for _, node := range nodes {
+			// fails for nodes the kernel doesn't know, which is fine
+			srv.InvalidateNodeData(node)
+			srv.InvalidateNodeAttr(node)
+		}
+
+		parentPath := path.Dir(file)
+		if parentPath == "." {
+			parentPath = ""
+		}
+		parent := Dir{path: parentPath, folder: folder, m: m}
+		srv.InvalidateEntry(parent, path.Base(file))
+		srv.InvalidateNodeAttr(parent)
+	}
+}
+
+// FS is either the combined mount of all folders, or the mount of a single
+// folder.
 type FS struct {
-	m *model.Model
+	m      *model.Model
+	folder string     // set for the mount of a single folder
+	hidden *folderSet // folders left out of the combined mount
 }
 
 func (fs FS) Root() (fs.Node, error) {
 	if debugFuse {
-		l.Debugln("Root")
+		l.Debugln("Root", fs.folder)
+	}
+	if fs.folder != "" {
+		return Dir{folder: fs.folder, m: fs.m}, nil
+	}
+	return STFolder{m: fs.m, hidden: fs.hidden}, nil
+}
+
+// shows returns whether the folder is in this mount.
+func (fs FS) shows(folder string) bool {
+	if fs.folder != "" {
+		return fs.folder == folder
+	}
+	return false == fs.hidden.contains(folder)
+}
+
+func (fs FS) volumeName() string {
+	if fs.folder != "" {
+		return "Syncthing FUSE " + fs.folder
+	}
+	return "Syncthing FUSE"
+}
+
+// Statfs reports the contents of all folders as used, and the room left in
+// the caches, bounded by the disk holding them, as free.
+func (fs FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	const blockSize = 4096
+
+	globalBytes, files := fs.m.GetGlobalSize()
+
+	maximum, cached := fs.m.GetCacheCapacity()
+	free := maximum - cached
+	if free < 0 {
+		free = 0
+	}
+	if diskFree, err := diskFreeBytes(filepath.Dir(locations[locConfigFile])); err == nil && diskFree < uint64(free) {
+		free = int64(diskFree)
+	}
+
+	if debugFuse {
+		l.Debugln("Statfs global bytes", globalBytes, "free bytes", free)
+	}
+
+	resp.Bsize = blockSize
+	resp.Frsize = blockSize
+	resp.Blocks = uint64((globalBytes + free + blockSize - 1) / blockSize)
+	resp.Bfree = uint64(free / blockSize)
+	resp.Bavail = resp.Bfree
+	resp.Files = uint64(files)
+	resp.Namelen = 255
+	return nil
+}
+
+func diskFreeBytes(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
 	}
-	return STFolder{m: fs.m}, nil
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
 }
 
 type STFolder struct {
-	m *model.Model
+	m      *model.Model
+	hidden *folderSet
 }
 
 func (stf STFolder) Attr(ctx context.Context, a *fuse.Attr) error {
 	if debugFuse {
 		l.Debugln("stf Attr")
 	}
+	a.Inode = rootInode
 	a.Mode = os.ModeDir | 0555
+	a.Uid = uint32(os.Getuid())
+	a.Gid = uint32(os.Getgid())
 	return nil
 }
 
@@ -103,7 +195,11 @@ func (stf STFolder) Lookup(ctx context.Context, folderName string) (fs.Node, err
 		l.Debugln("STF Lookup folder", folderName)
 	}
 
-	if stf.m.HasFolder(folderName) {
+	if folderName == statusDirName {
+		return StatusDir{m: stf.m}, nil
+	}
+
+	if stf.m.HasFolder(folderName) && false == stf.hidden.contains(folderName) {
 		return Dir{
 			folder: folderName,
 			m:      stf.m,
@@ -119,13 +215,20 @@ func (stf STFolder) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	}
 
 	entries := stf.m.GetFolders()
-	result := make([]fuse.Dirent, len(entries))
-	for i, entry := range entries {
-		result[i] = fuse.Dirent{
+	result := make([]fuse.Dirent, 0, len(entries)+1)
+	for _, entry := range entries {
+		if stf.hidden.contains(entry) {
+			continue
+		}
+		result = append(result, fuse.Dirent{
 			Name: entry,
 			Type: fuse.DT_Dir,
-		}
+		})
 	}
+	result = append(result, fuse.Dirent{
+		Name: statusDirName,
+		Type: fuse.DT_Dir,
+	})
 
 	return result, nil
 }
@@ -146,20 +249,23 @@ func (d Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 
 	// TODO assert directory?
 
-	a.Mode = os.ModeDir | 0555
-	a.Mtime = time.Unix(entry.ModifiedS, 0)
+	fillAttr(a, d.m, d.folder, d.path, entry)
+	a.Mode = os.ModeDir | permissions(entry, 0755)
 	return nil
 }
 
-func (d Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+func (d Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
 	if debugFuse {
-		l.Debugln("Dir Lookup folder", d.folder, "path", d.path, "for", name)
+		l.Debugln("Dir Lookup folder", d.folder, "path", d.path, "for", req.Name)
 	}
-	entry, found := d.m.GetEntry(d.folder, filepath.Join(d.path, name))
+	entry, found := d.m.GetEntry(d.folder, filepath.Join(d.path, req.Name))
 
 	if false == found {
 		return nil, fuse.ENOENT
 	}
+	if d.m.IsOfflineOnly(d.folder) && false == d.m.IsFileLocal(d.folder, entry) {
+		return nil, fuse.ENOENT
+	}
 
 	var node fs.Node
 	if entry.IsDirectory() {
@@ -168,6 +274,12 @@ func (d Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 			folder: d.folder,
 			m:      d.m,
 		}
+	} else if entry.IsSymlink() {
+		node = Symlink{
+			path:   entry.Name,
+			folder: d.folder,
+			m:      d.m,
+		}
 	} else {
 		node = File{
 			path:   entry.Name,
@@ -176,6 +288,7 @@ func (d Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		}
 	}
 
+	resp.EntryValid = entryValid
 	return node, nil
 }
 
@@ -187,21 +300,88 @@ func (d Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	p := path.Clean(d.path)
 
 	entries := d.m.GetChildren(d.folder, p)
-	result := make([]fuse.Dirent, len(entries))
-	for i, entry := range entries {
+	offlineOnly := d.m.IsOfflineOnly(d.folder)
+	result := make([]fuse.Dirent, 0, len(entries))
+	for _, entry := range entries {
+		if offlineOnly && false == d.m.IsFileLocal(d.folder, entry) {
+			continue
+		}
+
 		eType := fuse.DT_File
 		if entry.IsDirectory() {
 			eType = fuse.DT_Dir
+		} else if entry.IsSymlink() {
+			eType = fuse.DT_Link
 		}
-		result[i] = fuse.Dirent{
+		result = append(result, fuse.Dirent{
 			Name: path.Base(entry.Name),
 			Type: eType,
-		}
+		})
 	}
 
 	return result, nil
 }
 
+func (d Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if debugFuse {
+		l.Debugln("Dir Create folder", d.folder, "path", d.path, "for", req.Name)
+	}
+
+	p := filepath.Join(d.path, req.Name)
+	err := d.m.CreateFile(d.folder, p)
+	if err != nil {
+		return nil, nil, fuseError(err)
+	}
+
+	file := File{
+		path:   p,
+		folder: d.folder,
+		m:      d.m,
+	}
+	return file, FileHandle{file}, nil
+}
+
+func (d Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if debugFuse {
+		l.Debugln("Dir Mkdir folder", d.folder, "path", d.path, "for", req.Name)
+	}
+
+	p := filepath.Join(d.path, req.Name)
+	err := d.m.MakeDirectory(d.folder, p)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return Dir{
+		path:   p,
+		folder: d.folder,
+		m:      d.m,
+	}, nil
+}
+
+func (d Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if debugFuse {
+		l.Debugln("Dir Remove folder", d.folder, "path", d.path, "for", req.Name)
+	}
+
+	return fuseError(d.m.Remove(d.folder, filepath.Join(d.path, req.Name)))
+}
+
+func (d Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if debugFuse {
+		l.Debugln("Dir Rename folder", d.folder, "path", d.path, "from", req.OldName, "to", req.NewName)
+	}
+
+	target, ok := newDir.(Dir)
+	if !ok || target.folder != d.folder {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	from := filepath.Join(d.path, req.OldName)
+	to := filepath.Join(target.path, req.NewName)
+	return fuseError(d.m.Rename(d.folder, from, to))
+}
+
 // File implements both Node and Handle for the hello file.
 type File struct {
 	path   string
@@ -218,21 +398,192 @@ func (f File) Attr(ctx context.Context, a *fuse.Attr) error {
 		return fuse.ENOENT
 	}
 
-	a.Mode = 0444
-	a.Mtime = time.Unix(entry.ModifiedS, 0)
+	fillAttr(a, f.m, f.folder, f.path, entry)
+	a.Mode = permissions(entry, 0644)
 	a.Size = uint64(entry.Size)
 	return nil
 }
 
+func (f File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Flags.IsReadOnly() {
+		f.m.FileOpened(f.folder, f.path)
+		return ReadHandle{File: f, ra: model.NewReadAhead()}, nil
+	}
+
+	if debugFuse {
+		l.Debugln("File Open for write folder", f.folder, "path", f.path)
+	}
+
+	err := f.m.OpenFileForWrite(ctx, f.folder, f.path, req.Flags&fuse.OpenTruncate != 0)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return FileHandle{f}, nil
+}
+
+func (f File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if debugFuse {
+			l.Debugln("File Setattr size folder", f.folder, "path", f.path, "to", req.Size)
+		}
+
+		err := f.m.TruncateFile(ctx, f.folder, f.path, int64(req.Size))
+		if err != nil {
+			return fuseError(err)
+		}
+	}
+
+	return f.Attr(ctx, &resp.Attr)
+}
+
+func (f File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return fuseError(f.m.FlushFile(f.folder, f.path))
+}
+
 func (f File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	data, err := f.m.GetFileData(f.folder, f.path, req.Offset, req.Size)
+	data, err := f.m.GetFileData(ctx, f.folder, f.path, req.Offset, req.Size)
 
 	if err != nil {
-		return err
+		return fuseError(err)
+	}
+
+	resp.Data = data
+
+	return err
+}
+
+// ReadHandle is a handle for a file opened for reading. It prefetches ahead
+// of sequential reads.
+type ReadHandle struct {
+	File
+	ra *model.ReadAhead
+}
+
+func (rh ReadHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	data, err := rh.m.ReadFileData(ctx, rh.ra, rh.folder, rh.path, req.Offset, req.Size)
+	if err != nil {
+		return fuseError(err)
 	}
 
 	resp.Data = data
+	return nil
+}
 
+// FileHandle is a handle for a file opened for writing.
+type FileHandle struct {
+	File
+}
+
+func (fh FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n, err := fh.m.WriteFileData(fh.folder, fh.path, req.Offset, req.Data)
+	resp.Size = n
+	return fuseError(err)
+}
+
+func (fh FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return fuseError(fh.m.FlushFile(fh.folder, fh.path))
+}
+
+func (fh FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if debugFuse {
+		l.Debugln("FileHandle Release folder", fh.folder, "path", fh.path)
+	}
+
+	return fuseError(fh.m.ReleaseFile(fh.folder, fh.path))
+}
+
+// Symlink implements Node for symlinks.
+type Symlink struct {
+	path   string
+	folder string
+	m      *model.Model
+}
+
+func (s Symlink) Attr(ctx context.Context, a *fuse.Attr) error {
+	entry, found := s.m.GetEntry(s.folder, s.path)
+	if false == found {
+		return fuse.ENOENT
+	}
+
+	fillAttr(a, s.m, s.folder, s.path, entry)
+	a.Mode = os.ModeSymlink | 0777
+	a.Size = uint64(entry.Size)
+	return nil
+}
+
+func (s Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if debugFuse {
+		l.Debugln("Symlink Readlink folder", s.folder, "path", s.path)
+	}
+
+	target, err := s.m.GetSymlinkTarget(ctx, s.folder, s.path)
+	if err != nil {
+		return "", fuseError(err)
+	}
+
+	return target, nil
+}
+
+// rootInode is the inode of the mount root, which lists the folders.
+const rootInode = 1
+
+// fillAttr sets the attributes all nodes of a folder share.
+func fillAttr(a *fuse.Attr, m *model.Model, folder string, path string, entry protocol.FileInfo) {
+	a.Inode = inode(folder, path)
+	a.Uid, a.Gid = m.GetOwnership(folder)
+	a.Mtime = time.Unix(entry.ModifiedS, int64(entry.ModifiedNs))
+	a.Valid = attrValid
+}
+
+// permissions returns the permission bits announced for the entry, or the
+// default if the peer doesn't track them.
+func permissions(entry protocol.FileInfo, defaultPermissions os.FileMode) os.FileMode {
+	if entry.NoPermissions || entry.Permissions == 0 {
+		return defaultPermissions
+	}
+	return os.FileMode(entry.Permissions) & os.ModePerm
+}
+
+// inode derives a stable inode number from the folder and path, so tools
+// comparing inodes see the same file across lookups and restarts.
+func inode(folder string, path string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(folder))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+
+	ino := h.Sum64()
+	if ino <= rootInode {
+		ino += rootInode + 1
+	}
+	return ino
+}
+
+// fuseError translates model errors into the errno the kernel expects.
+func fuseError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case protocol.ErrNoSuchFile:
+		return fuse.ENOENT
+	case model.ErrFileExists:
+		return fuse.EEXIST
+	case model.ErrDirectoryNotEmpty:
+		return fuse.Errno(syscall.ENOTEMPTY)
+	case model.ErrIsDirectory:
+		return fuse.Errno(syscall.EISDIR)
+	case model.ErrNotStoredLocally:
+		// tools like mv then copy and delete instead, which fetches the data
+		return fuse.Errno(syscall.EXDEV)
+	case model.ErrPinnedByRule:
+		return fuse.Errno(syscall.EPERM)
+	case model.ErrReadTimeout:
+		return fuse.EIO
+	case context.Canceled:
+		// interrupted
+		return fuse.EINTR
+	}
 	return err
 }
 
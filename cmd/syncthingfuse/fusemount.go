@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/burkemw3/syncthingfuse/lib/config"
+	"github.com/burkemw3/syncthingfuse/lib/model"
+)
+
+// fuseMount is a service serving one FUSE mount point. It mounts when
+// started, and unmounts when stopped. A mount unmounted by someone else stays
+// unmounted until shutdown.
+type fuseMount struct {
+	mountPoint string
+	root       FS
+	m          *model.Model
+
+	stop          chan struct{}
+	stopOnce      sync.Once
+	unmounted     chan struct{} // closed when unmounted by someone else
+	unmountedOnce sync.Once
+
+	mut sync.Mutex
+	srv *fs.Server // nil while not mounted
+}
+
+func newFuseMount(mountPoint string, root FS, m *model.Model) *fuseMount {
+	fm := &fuseMount{
+		mountPoint: mountPoint,
+		root:       root,
+		m:          m,
+		stop:       make(chan struct{}),
+		unmounted:  make(chan struct{}),
+	}
+
+	m.OnChange(fm.invalidate)
+
+	return fm
+}
+
+// newFuseMounts returns the combined mount of all folders, and one mount for
+// each folder with its own mount point.
+func newFuseMounts(cfg *config.Wrapper, m *model.Model) []*fuseMount {
+	hidden := &folderSet{ids: make(map[string]bool)}
+	mounts := []*fuseMount{
+		newFuseMount(cfg.Raw().MountPoint, FS{m: m, hidden: hidden}, m),
+	}
+
+	for _, fldrCfg := range cfg.Raw().Folders {
+		if fldrCfg.SkipCombinedMount {
+			hidden.ids[fldrCfg.ID] = true
+		}
+
+		mountPoint, err := fldrCfg.GetMountPoint()
+		if err != nil {
+			l.Warnln("Cannot mount folder", fldrCfg.ID, "at", fldrCfg.MountPoint, err)
+			continue
+		}
+		if mountPoint != "" {
+			mounts = append(mounts, newFuseMount(mountPoint, FS{m: m, folder: fldrCfg.ID}, m))
+		}
+	}
+
+	return mounts
+}
+
+// mountPoints returns all mount points in the configuration.
+func mountPoints(cfg *config.Wrapper) []string {
+	points := []string{cfg.Raw().MountPoint}
+	for _, fldrCfg := range cfg.Raw().Folders {
+		if mountPoint, err := fldrCfg.GetMountPoint(); err == nil && mountPoint != "" {
+			points = append(points, mountPoint)
+		}
+	}
+	return points
+}
+
+func (fm *fuseMount) Serve() {
+	c, err := fuse.Mount(
+		fm.mountPoint,
+		fuse.FSName("syncthingfuse"),
+		fuse.Subtype("syncthingfuse"),
+		fuse.LocalVolume(),
+		fuse.VolumeName(fm.root.volumeName()),
+	)
+	if err != nil {
+		l.Warnln("Cannot mount", fm.mountPoint, err)
+		return // the supervisor tries again
+	}
+	defer c.Close()
+
+	srv := fs.New(c, nil)
+	fm.setServer(srv)
+
+	// stopped while mounting, so nobody else unmounts
+	select {
+	case <-fm.stop:
+		fm.unmount()
+	default:
+	}
+
+	err = srv.Serve(fm.root)
+	fm.setServer(nil)
+
+	// check if the mount process has an error to report
+	<-c.Ready
+	if err := c.MountError; err != nil {
+		l.Warnln("Mount error at", fm.mountPoint, err)
+	}
+
+	select {
+	case <-fm.stop:
+		return
+	default:
+	}
+
+	if err != nil {
+		l.Warnln("Serving", fm.mountPoint, "failed:", err)
+		return // the supervisor mounts again
+	}
+
+	l.Infoln("Unmounted", fm.mountPoint, "from outside, keeping it unmounted")
+	fm.unmountedOnce.Do(func() {
+		close(fm.unmounted)
+	})
+	<-fm.stop
+}
+
+func (fm *fuseMount) Stop() {
+	fm.stopOnce.Do(func() {
+		close(fm.stop)
+	})
+
+	fm.mut.Lock()
+	mounted := fm.srv != nil
+	fm.mut.Unlock()
+
+	if mounted {
+		fm.unmount()
+	}
+}
+
+func (fm *fuseMount) String() string {
+	return "fuseMount@" + fm.mountPoint
+}
+
+func (fm *fuseMount) unmount() {
+	l.Infoln("Unmounting", fm.mountPoint)
+	if err := Unmount(fm.mountPoint); err == nil {
+		l.Infoln("Unmounted", fm.mountPoint)
+	} else {
+		l.Infoln("Unmount of", fm.mountPoint, "failed:", err)
+	}
+}
+
+func (fm *fuseMount) setServer(srv *fs.Server) {
+	fm.mut.Lock()
+	fm.srv = srv
+	fm.mut.Unlock()
+}
+
+func (fm *fuseMount) invalidate(folder string, files []string) {
+	fm.mut.Lock()
+	srv := fm.srv
+	fm.mut.Unlock()
+
+	if srv != nil && fm.root.shows(folder) {
+		invalidate(srv, fm.m, folder, files)
+	}
+}
+
+// ensureMountPoint creates a missing mount point, and exits if it cannot be
+// used.
+func ensureMountPoint(mountPoint string) {
+	if info, err := os.Stat(mountPoint); err == nil {
+		if !info.Mode().IsDir() {
+			l.Fatalln("Mount point (", mountPoint, ") must be a directory, but isn't")
+			os.Exit(1)
+		}
+	} else {
+		l.Infoln("Mount point (", mountPoint, ") does not exist, creating it")
+		err = os.MkdirAll(mountPoint, 0700)
+		if err != nil {
+			l.Warnln("Error creating mount point", mountPoint, err)
+			l.Warnln("Sometimes, SyncthingFUSE doesn't shut down and unmount cleanly,")
+			l.Warnln("If you don't know of any other file systems you have mounted at")
+			l.Warnln("the mount point, try running the command below to unmount, then")
+			l.Warnln("start SyncthingFUSE again.")
+			l.Warnln("    umount", mountPoint)
+			l.Fatalln("Cannot create missing mount point")
+			os.Exit(1)
+		}
+	}
+}
+
+// folderSet is a set of folder IDs. Nodes hold it by pointer, since the FUSE
+// server compares nodes.
+type folderSet struct {
+	ids map[string]bool
+}
+
+func (s *folderSet) contains(folder string) bool {
+	return s != nil && s.ids[folder]
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/burkemw3/syncthingfuse/lib/model"
+	"golang.org/x/net/context"
+)
+
+// statusDirName is the read-only directory at the root of the mount that
+// exposes the state of SyncthingFUSE as files.
+const statusDirName = ".syncthingfuse"
+
+var statusFiles = map[string]func(m *model.Model) []byte{
+	"connections": connectionsStatus,
+	"cache":       cacheStatus,
+	"pins":        pinsStatus,
+	"pulls":       pullsStatus,
+}
+
+// StatusDir implements Node for the status directory.
+type StatusDir struct {
+	m *model.Model
+}
+
+func (sd StatusDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (sd StatusDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if debugFuse {
+		l.Debugln("StatusDir Lookup", name)
+	}
+
+	if _, ok := statusFiles[name]; ok {
+		return StatusFile{name: name, m: sd.m}, nil
+	}
+
+	return nil, fuse.ENOENT
+}
+
+func (sd StatusDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	result := make([]fuse.Dirent, 0, len(statusFiles))
+	for name := range statusFiles {
+		result = append(result, fuse.Dirent{
+			Name: name,
+			Type: fuse.DT_File,
+		})
+	}
+
+	return result, nil
+}
+
+// StatusFile implements Node for a file in the status directory. Contents
+// are generated when the file is opened.
+type StatusFile struct {
+	name string
+	m    *model.Model
+}
+
+func (sf StatusFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0444
+	// the size is only known once the contents are generated, and reads go
+	// around the page cache, so they aren't cut short by it
+	a.Size = 0
+	return nil
+}
+
+func (sf StatusFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if false == req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+
+	// the size isn't reported by stat, so bypass the page cache
+	resp.Flags |= fuse.OpenDirectIO
+
+	return StatusHandle{data: statusFiles[sf.name](sf.m)}, nil
+}
+
+// StatusHandle holds a snapshot of a status file for one open.
+type StatusHandle struct {
+	data []byte
+}
+
+func (sh StatusHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	return sh.data, nil
+}
+
+func connectionsStatus(m *model.Model) []byte {
+	lines := make([]string, 0)
+	for _, ci := range m.GetConnections() {
+		lines = append(lines, fmt.Sprintf("%s %s %dms %dB/s %d", ci.DeviceID, ci.Address, ci.Latency/time.Millisecond, ci.Throughput, ci.Failures))
+	}
+	return sortedLines(lines)
+}
+
+func cacheStatus(m *model.Model) []byte {
+	lines := make([]string, 0)
+	for _, ci := range m.GetCacheUsage() {
+		lines = append(lines, fmt.Sprintf("%s %d %d", ci.Folder, ci.CachedBytes, ci.MaximumBytes))
+	}
+	return sortedLines(lines)
+}
+
+func pinsStatus(m *model.Model) []byte {
+	lines := make([]string, 0)
+	for folder, status := range m.GetPinsStatusByFolder() {
+		lines = append(lines, fmt.Sprintf("%s %s", folder, status))
+	}
+	return sortedLines(lines)
+}
+
+func pullsStatus(m *model.Model) []byte {
+	lines := make([]string, 0)
+	for _, pi := range m.GetPulls() {
+		lines = append(lines, fmt.Sprintf("%s %s %d %s", pi.Folder, pi.File, pi.Offset, pi.Comment))
+	}
+	return sortedLines(lines)
+}
+
+func sortedLines(lines []string) []byte {
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
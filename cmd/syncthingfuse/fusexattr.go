@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/burkemw3/syncthingfuse/lib/model"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"golang.org/x/net/context"
+)
+
+// Extended attributes report, and control, what is stored locally.
+const (
+	xattrCachedBytes = "user.syncthingfuse.cached_bytes"
+	xattrPinned      = "user.syncthingfuse.pinned"
+	xattrDevices     = "user.syncthingfuse.devices"
+	xattrVersion     = "user.syncthingfuse.version"
+)
+
+func (d Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(d.m, d.folder, d.path, req, resp)
+}
+
+func (d Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(d.m, d.folder, d.path, req, resp)
+}
+
+func (d Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return setxattr(d.m, d.folder, d.path, req.Name, string(req.Xattr))
+}
+
+func (d Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return removexattr(d.m, d.folder, d.path, req.Name)
+}
+
+func (f File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(f.m, f.folder, f.path, req, resp)
+}
+
+func (f File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(f.m, f.folder, f.path, req, resp)
+}
+
+func (f File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return setxattr(f.m, f.folder, f.path, req.Name, string(req.Xattr))
+}
+
+func (f File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return removexattr(f.m, f.folder, f.path, req.Name)
+}
+
+func getxattr(m *model.Model, folder string, path string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if debugFuse {
+		l.Debugln("Getxattr folder", folder, "path", path, "name", req.Name)
+	}
+
+	// the folder root has no entry, so only whether it is pinned applies
+	var entry protocol.FileInfo
+	if path != "" {
+		var found bool
+		entry, found = m.GetEntry(folder, path)
+		if false == found {
+			return fuse.ENOENT
+		}
+	} else if req.Name != xattrPinned {
+		return fuse.ErrNoXattr
+	}
+
+	var value string
+	switch req.Name {
+	case xattrCachedBytes:
+		value = strconv.FormatInt(m.GetCachedBytes(folder, path), 10)
+	case xattrPinned:
+		value = "0"
+		if m.IsFilePinned(folder, path) {
+			value = "1"
+		}
+	case xattrDevices:
+		devices := make([]string, 0)
+		for _, device := range m.GetEntryDevices(folder, path) {
+			devices = append(devices, device.String())
+		}
+		value = strings.Join(devices, ",")
+	case xattrVersion:
+		counters := make([]string, 0)
+		for _, counter := range entry.Version.Counters {
+			counters = append(counters, fmt.Sprintf("%v:%d", counter.ID, counter.Value))
+		}
+		value = strings.Join(counters, ",")
+	default:
+		return fuse.ErrNoXattr
+	}
+
+	resp.Xattr = []byte(value)
+	return nil
+}
+
+func listxattr(m *model.Model, folder string, path string, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if path == "" {
+		resp.Append(xattrPinned)
+		return nil
+	}
+	resp.Append(xattrCachedBytes, xattrPinned, xattrDevices, xattrVersion)
+	return nil
+}
+
+func setxattr(m *model.Model, folder string, path string, name string, value string) error {
+	if debugFuse {
+		l.Debugln("Setxattr folder", folder, "path", path, "name", name, "value", value)
+	}
+
+	if name != xattrPinned {
+		return fuse.Errno(syscall.EPERM)
+	}
+
+	var pinned bool
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes":
+		pinned = true
+	case "", "0", "false", "no":
+		pinned = false
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	return fuseError(m.SetFilePinned(folder, path, pinned))
+}
+
+// removexattr unpins, the only attribute that is ever set.
+func removexattr(m *model.Model, folder string, path string, name string) error {
+	if name != xattrPinned {
+		return fuse.ErrNoXattr
+	}
+	return setxattr(m, folder, path, name, "0")
+}
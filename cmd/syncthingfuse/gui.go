@@ -112,11 +112,13 @@ func (s *apiSvc) getMux() *http.ServeMux {
 	getApiMux.HandleFunc("/api/system/config/insync", s.getSystemConfigInSync)
 	getApiMux.HandleFunc("/api/system/connections", s.getSystemConnections)
 	getApiMux.HandleFunc("/api/system/pins/status", s.getPinStatus)
+	getApiMux.HandleFunc("/api/system/metered", s.getSystemMetered)
 	getApiMux.HandleFunc("/api/verify/deviceid", s.getDeviceID) // id
 	getApiMux.HandleFunc("/api/db/browse", s.getDBBrowse)       // folderID pathPrefix
 
 	postApiMux := http.NewServeMux()
 	postApiMux.HandleFunc("/api/system/config", s.postSystemConfig)       // <body>
+	postApiMux.HandleFunc("/api/system/metered", s.postSystemMetered)     // override=auto|on|off
 	postApiMux.HandleFunc("/api/verify/humansize", s.postVerifyHumanSize) // <body>
 
 	apiMux := getMethodHandler(getApiMux, postApiMux)
@@ -194,6 +196,19 @@ func (s *apiSvc) getPinStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(s.model.GetPinsStatusByFolder())
 }
 
+func (s *apiSvc) getSystemMetered(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.model.GetMeteredStatus())
+}
+
+func (s *apiSvc) postSystemMetered(w http.ResponseWriter, r *http.Request) {
+	override := model.MeteredOverride(r.URL.Query().Get("override"))
+	if err := s.model.SetMeteredOverride(override); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+}
+
 func (s *apiSvc) getDeviceID(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	idStr := qs.Get("id")
@@ -235,11 +250,11 @@ func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 
 	// Activate and save
 	err = s.cfg.Replace(to)
-	s.configInSync = false
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
+	s.configInSync = !s.cfg.RequiresRestart()
 	s.cfg.Save()
 }
 
@@ -5,7 +5,6 @@ import (
 	"flag"
 	"fmt"
 	"net"
-	"os"
 	"path"
 	"time"
 
@@ -96,24 +95,8 @@ func main() {
 
 	cfg := getConfiguration()
 
-	if info, err := os.Stat(cfg.Raw().MountPoint); err == nil {
-		if !info.Mode().IsDir() {
-			l.Fatalln("Mount point (", cfg.Raw().MountPoint, ") must be a directory, but isn't")
-			os.Exit(1)
-		}
-	} else {
-		l.Infoln("Mount point (", cfg.Raw().MountPoint, ") does not exist, creating it")
-		err = os.MkdirAll(cfg.Raw().MountPoint, 0700)
-		if err != nil {
-			l.Warnln("Error creating mount point", cfg.Raw().MountPoint, err)
-			l.Warnln("Sometimes, SyncthingFUSE doesn't shut down and unmount cleanly,")
-			l.Warnln("If you don't know of any other file systems you have mounted at")
-			l.Warnln("the mount point, try running the command below to unmount, then")
-			l.Warnln("start SyncthingFUSE again.")
-			l.Warnln("    umount", cfg.Raw().MountPoint)
-			l.Fatalln("Cannot create missing mount point")
-			os.Exit(1)
-		}
+	for _, mountPoint := range mountPoints(cfg) {
+		ensureMountPoint(mountPoint)
 	}
 
 	mainSvc := suture.New("main", suture.Spec{
@@ -180,7 +163,7 @@ func main() {
 
 	l.Infoln("Started ...")
 
-	MountFuse(cfg.Raw().MountPoint, m, mainSvc) // TODO handle fight between FUSE and Syncthing Service
+	MountFuse(cfg, m, mainSvc) // TODO handle fight between FUSE and Syncthing Service
 
 	l.Okln("Exiting")
 
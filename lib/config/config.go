@@ -2,15 +2,21 @@ package config
 
 import (
 	"encoding/xml"
+	"errors"
 	"io"
+	"math"
+	"net"
+	"os"
 	"os/user"
 	"path"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	human "github.com/dustin/go-humanize"
 	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/osutil"
 	"github.com/syncthing/syncthing/lib/protocol"
 )
 
@@ -30,10 +36,22 @@ type Configuration struct {
 }
 
 type FolderConfiguration struct {
-	ID          string                             `xml:"id,attr" json:"id"`
-	Devices     []config.FolderDeviceConfiguration `xml:"device" json:"devices"`
-	CacheSize   string                             `xml:"cacheSize" json:"cacheSize" default:"512MiB"`
-	PinnedFiles []string                           `xml:"pinnedFiles" json:"pinnedFiles"`
+	ID                string                             `xml:"id,attr" json:"id"`
+	Devices           []config.FolderDeviceConfiguration `xml:"device" json:"devices"`
+	CacheSize         string                             `xml:"cacheSize" json:"cacheSize" default:"512MiB"`
+	CacheMinimum      string                             `xml:"cacheMinimum,omitempty" json:"cacheMinimum"` // only used with a global cache size
+	CacheMaximum      string                             `xml:"cacheMaximum,omitempty" json:"cacheMaximum"` // only used with a global cache size
+	CachePolicy       string                             `xml:"cachePolicy,omitempty" json:"cachePolicy"`
+	Owner             string                             `xml:"owner,omitempty" json:"owner"`                         // user name or id files appear to belong to
+	Group             string                             `xml:"group,omitempty" json:"group"`                         // group name or id files appear to belong to
+	OfflineOnly       bool                               `xml:"offlineOnly,omitempty" json:"offlineOnly"`             // only show files stored locally
+	MountPoint        string                             `xml:"mountPoint,omitempty" json:"mountPoint"`               // also mount the folder on its own here
+	SkipCombinedMount bool                               `xml:"skipCombinedMount,omitempty" json:"skipCombinedMount"` // leave out of the mount of all folders
+	PrefetchSiblings  int                                `xml:"prefetchSiblings,omitempty" json:"prefetchSiblings"`   // following files to warm when files are opened in order
+	PrefetchBytes     string                             `xml:"prefetchBytes,omitempty" json:"prefetchBytes"`         // leading bytes to warm of each
+	PrefetchOrder     string                             `xml:"prefetchOrder,omitempty" json:"prefetchOrder"`         // name, size or mtime
+	PinnedFiles       []string                           `xml:"pinnedFiles" json:"pinnedFiles"`                       // paths, pinning a file or everything below a directory
+	PinnedPatterns    []string                           `xml:"pinnedPattern" json:"pinnedPatterns"`                  // glob patterns, e.g. Photos/2024/** or *.pdf
 }
 
 type GUIConfiguration struct {
@@ -41,22 +59,306 @@ type GUIConfiguration struct {
 	RawAddress string `xml:"address" json:"address" default:"127.0.0.1:5833"`
 }
 
-func (f FolderConfiguration) GetCacheSizeBytes() (int32, error) {
-	bytes, err := human.ParseBytes(f.CacheSize)
-	return int32(bytes), err
+const (
+	CachePolicyLRU = "lru"
+	CachePolicy2Q  = "2q"
+)
+
+const (
+	PrefetchOrderName  = "name"
+	PrefetchOrderSize  = "size"
+	PrefetchOrderMtime = "mtime"
+)
+
+var (
+	errCacheSizeTooLarge  = errors.New("cache size too large")
+	errUnknownCachePolicy = errors.New("unknown cache policy")
+	errMountPointInUse    = errors.New("mount point used more than once")
+	errUnknownOrder       = errors.New("unknown prefetch order")
+	errBadSchedule        = errors.New("schedule must look like 22:00-07:00")
+	errBadNetwork         = errors.New("metered network must be an interface name or a CIDR range")
+)
+
+func (f FolderConfiguration) GetCacheSizeBytes() (int64, error) {
+	return parseSize(f.CacheSize)
+}
+
+// GetCacheMinimumBytes returns the share of the global cache kept for this
+// folder, or 0 if unset.
+func (f FolderConfiguration) GetCacheMinimumBytes() (int64, error) {
+	return parseOptionalSize(f.CacheMinimum)
+}
+
+// GetCacheMaximumBytes returns the most of the global cache this folder may
+// use, or 0 if unset.
+func (f FolderConfiguration) GetCacheMaximumBytes() (int64, error) {
+	return parseOptionalSize(f.CacheMaximum)
+}
+
+// GetCachePolicy returns the eviction policy of the folder cache, LRU unless
+// configured otherwise.
+func (f FolderConfiguration) GetCachePolicy() (string, error) {
+	switch strings.ToLower(strings.TrimSpace(f.CachePolicy)) {
+	case "", CachePolicyLRU:
+		return CachePolicyLRU, nil
+	case CachePolicy2Q:
+		return CachePolicy2Q, nil
+	default:
+		return "", errUnknownCachePolicy
+	}
+}
+
+// GetPrefetchBytes returns how many leading bytes of following files are
+// prefetched, by default one block.
+func (f FolderConfiguration) GetPrefetchBytes() (int64, error) {
+	if strings.TrimSpace(f.PrefetchBytes) == "" {
+		return protocol.BlockSize, nil
+	}
+	return parseSize(f.PrefetchBytes)
+}
+
+// GetPrefetchOrder returns the order in which files of a directory are
+// expected to be opened, by name unless configured otherwise.
+func (f FolderConfiguration) GetPrefetchOrder() (string, error) {
+	switch order := strings.ToLower(strings.TrimSpace(f.PrefetchOrder)); order {
+	case "":
+		return PrefetchOrderName, nil
+	case PrefetchOrderName, PrefetchOrderSize, PrefetchOrderMtime:
+		return order, nil
+	default:
+		return "", errUnknownOrder
+	}
+}
+
+// GetMountPoint returns where the folder is mounted on its own, or "" if it
+// isn't.
+func (f FolderConfiguration) GetMountPoint() (string, error) {
+	mountPoint := strings.TrimSpace(f.MountPoint)
+	if mountPoint == "" {
+		return "", nil
+	}
+	return osutil.ExpandTilde(mountPoint)
+}
+
+// CheckMountPoints returns an error if two mounts share a mount point.
+func (cfg Configuration) CheckMountPoints() error {
+	used := map[string]bool{
+		path.Clean(cfg.MountPoint): true,
+	}
+	for _, fldrCfg := range cfg.Folders {
+		mountPoint, err := fldrCfg.GetMountPoint()
+		if err != nil {
+			return err
+		}
+		if mountPoint == "" {
+			continue
+		}
+		mountPoint = path.Clean(mountPoint)
+		if used[mountPoint] {
+			return errMountPointInUse
+		}
+		used[mountPoint] = true
+	}
+	return nil
+}
+
+// GetOwnership returns the user and group ids that files in the folder
+// appear to belong to, by default those running SyncthingFUSE.
+func (f FolderConfiguration) GetOwnership() (uint32, uint32, error) {
+	uid := uint32(os.Getuid())
+	gid := uint32(os.Getgid())
+
+	if owner := strings.TrimSpace(f.Owner); owner != "" {
+		id, err := strconv.ParseUint(owner, 10, 32)
+		if err != nil {
+			u, lookupErr := user.Lookup(owner)
+			if lookupErr != nil {
+				return 0, 0, lookupErr
+			}
+			id, err = strconv.ParseUint(u.Uid, 10, 32)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		uid = uint32(id)
+	}
+
+	if group := strings.TrimSpace(f.Group); group != "" {
+		id, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			g, lookupErr := user.LookupGroup(group)
+			if lookupErr != nil {
+				return 0, 0, lookupErr
+			}
+			id, err = strconv.ParseUint(g.Gid, 10, 32)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		gid = uint32(id)
+	}
+
+	return uid, gid, nil
+}
+
+func parseSize(size string) (int64, error) {
+	bytes, err := human.ParseBytes(size)
+	if err != nil {
+		return 0, err
+	}
+	if bytes > math.MaxInt64 {
+		return 0, errCacheSizeTooLarge
+	}
+	return int64(bytes), nil
+}
+
+func parseOptionalSize(size string) (int64, error) {
+	if strings.TrimSpace(size) == "" {
+		return 0, nil
+	}
+	return parseSize(size)
 }
 
 type OptionsConfiguration struct {
-	ListenAddress              []string `xml:"listenAddress" json:"listenAddress" default:"tcp://0.0.0.0:22000"`
-	LocalAnnounceEnabled       bool     `xml:"localAnnounceEnabled" json:"localAnnounceEnabled" default:"true"`
-	LocalAnnouncePort          int      `xml:"localAnnouncePort" json:"localAnnouncePort" default:"21027"`
-	LocalAnnounceMCAddr        string   `xml:"localAnnounceMCAddr" json:"localAnnounceMCAddr"`
-	GlobalAnnounceEnabled      bool     `xml:"globalAnnounceEnabled" json:"globalAnnounceEnabled" default:"true"`
-	GlobalAnnounceServers      []string `xml:"globalAnnounceServer" json:"globalAnnounceServers" default:"default"`
-	RelaysEnabled              bool     `xml:"relaysEnabled" json:"relaysEnabled" default:"true"`
-	RelayWithoutGlobalAnnounce bool     `xml:"relayWithoutGlobalAnn" json:"relayWithoutGlobalAnn" default:"false"`
-	RelayServers               []string `xml:"relayServer" json:"relayServers" default:"dynamic+https://relays.syncthing.net/endpoint"`
-	RelayReconnectIntervalM    int      `xml:"relayReconnectIntervalM" json:"relayReconnectIntervalM" default:"10"`
+	ListenAddress              []string          `xml:"listenAddress" json:"listenAddress" default:"tcp://0.0.0.0:22000"`
+	LocalAnnounceEnabled       bool              `xml:"localAnnounceEnabled" json:"localAnnounceEnabled" default:"true"`
+	LocalAnnouncePort          int               `xml:"localAnnouncePort" json:"localAnnouncePort" default:"21027"`
+	LocalAnnounceMCAddr        string            `xml:"localAnnounceMCAddr" json:"localAnnounceMCAddr"`
+	GlobalAnnounceEnabled      bool              `xml:"globalAnnounceEnabled" json:"globalAnnounceEnabled" default:"true"`
+	GlobalAnnounceServers      []string          `xml:"globalAnnounceServer" json:"globalAnnounceServers" default:"default"`
+	RelaysEnabled              bool              `xml:"relaysEnabled" json:"relaysEnabled" default:"true"`
+	RelayWithoutGlobalAnnounce bool              `xml:"relayWithoutGlobalAnn" json:"relayWithoutGlobalAnn" default:"false"`
+	RelayServers               []string          `xml:"relayServer" json:"relayServers" default:"dynamic+https://relays.syncthing.net/endpoint"`
+	RelayReconnectIntervalM    int               `xml:"relayReconnectIntervalM" json:"relayReconnectIntervalM" default:"10"`
+	CacheSize                  string            `xml:"cacheSize,omitempty" json:"cacheSize"`
+	ReadTimeoutS               int               `xml:"readTimeoutS" json:"readTimeoutS" default:"60"`              // 0 waits for peers forever
+	ReadAheadMaximum           string            `xml:"readAheadMaximum" json:"readAheadMaximum" default:"16MiB"`   // per open file
+	ReadAheadInFlight          string            `xml:"readAheadInFlight" json:"readAheadInFlight" default:"64MiB"` // for all open files
+	PullWorkers                int               `xml:"pullWorkers" json:"pullWorkers" default:"16"`                // blocks pulled at once
+	PullsPerDevice             int               `xml:"pullsPerDevice" json:"pullsPerDevice" default:"4"`           // blocks requested from one device at once, 0 for no limit
+	MaxRecvKbps                int               `xml:"maxRecvKbps" json:"maxRecvKbps"`                             // KiB/s pulled from all devices, 0 for no limit
+	MaxPinRecvKbps             int               `xml:"maxPinRecvKbps" json:"maxPinRecvKbps"`                       // KiB/s pulled for pinned files, 0 for no limit
+	DeviceRateLimits           []DeviceRateLimit `xml:"deviceRateLimit" json:"deviceRateLimits"`
+	PinSchedule                string            `xml:"pinSchedule,omitempty" json:"pinSchedule"` // times of day to fill pins, e.g. "22:00-07:00", empty for always
+	MeteredNetworks            []string          `xml:"meteredNetwork" json:"meteredNetworks"`    // interface names or CIDR ranges
+}
+
+// DeviceRateLimit limits how fast blocks are pulled from one device.
+type DeviceRateLimit struct {
+	DeviceID    protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	MaxRecvKbps int               `xml:"maxRecvKbps" json:"maxRecvKbps"`
+}
+
+// DailyWindow is a time of day range. Windows ending before they start span
+// midnight.
+type DailyWindow struct {
+	Start time.Duration // since midnight
+	End   time.Duration
+}
+
+// Contains returns whether the time of day of t is in the window.
+func (w DailyWindow) Contains(t time.Time) bool {
+	hour, min, sec := t.Clock()
+	now := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	if w.Start <= w.End {
+		return w.Start <= now && now < w.End
+	}
+	return w.Start <= now || now < w.End
+}
+
+// GetPinSchedule returns the times of day pins are filled, or nothing to
+// fill them any time.
+func (o OptionsConfiguration) GetPinSchedule() ([]DailyWindow, error) {
+	return parseSchedule(o.PinSchedule)
+}
+
+// GetMeteredNetworks returns the interfaces and address ranges of networks
+// marked metered.
+func (o OptionsConfiguration) GetMeteredNetworks() ([]string, []*net.IPNet, error) {
+	interfaces := make([]string, 0)
+	networks := make([]*net.IPNet, 0)
+	for _, network := range o.MeteredNetworks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+
+		if false == strings.Contains(network, "/") {
+			interfaces = append(interfaces, network)
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, nil, errBadNetwork
+		}
+		networks = append(networks, ipNet)
+	}
+	return interfaces, networks, nil
+}
+
+// parseSchedule parses comma separated windows like "22:00-07:00".
+func parseSchedule(schedule string) ([]DailyWindow, error) {
+	windows := make([]DailyWindow, 0)
+	for _, part := range strings.Split(schedule, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.Split(part, "-")
+		if len(bounds) != 2 {
+			return nil, errBadSchedule
+		}
+		start, err := parseTimeOfDay(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, DailyWindow{Start: start, End: end})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, errBadSchedule
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// GetCacheSizeBytes returns the size of the cache shared by all folders, or 0
+// if each folder uses its own cache size.
+func (o OptionsConfiguration) GetCacheSizeBytes() (int64, error) {
+	return parseOptionalSize(o.CacheSize)
+}
+
+// GetReadAheadLimits returns how far ahead of sequential reads of one file
+// blocks are prefetched, and how many prefetched bytes may be in flight for
+// all files together.
+func (o OptionsConfiguration) GetReadAheadLimits() (int64, int64, error) {
+	maximum, err := parseOptionalSize(o.ReadAheadMaximum)
+	if err != nil {
+		return 0, 0, err
+	}
+	inFlight, err := parseOptionalSize(o.ReadAheadInFlight)
+	if err != nil {
+		return 0, 0, err
+	}
+	return maximum, inFlight, nil
+}
+
+// GetReadTimeout returns how long a read waits for blocks from peers, or 0
+// to wait forever.
+func (o OptionsConfiguration) GetReadTimeout() time.Duration {
+	if o.ReadTimeoutS < 0 {
+		return 0
+	}
+	return time.Duration(o.ReadTimeoutS) * time.Second
 }
 
 func New(myID protocol.DeviceID, myName string) Configuration {
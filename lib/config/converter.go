@@ -5,25 +5,48 @@ import (
 	"github.com/syncthing/syncthing/lib/protocol"
 )
 
+// AsStCfg returns a Syncthing configuration wrapper for the Syncthing
+// services we use. It follows later changes to this configuration.
 func (w *Wrapper) AsStCfg(myID protocol.DeviceID) *stconfig.Wrapper {
+	stCfg := stconfig.Wrap("/shouldnotexist", asStConfiguration(w.Raw(), myID))
+	w.Subscribe(&stCfgFollower{
+		stCfg: stCfg,
+		myID:  myID,
+	})
+	return stCfg
+}
+
+func asStConfiguration(raw Configuration, myID protocol.DeviceID) stconfig.Configuration {
 	cfg := stconfig.New(myID)
 
-	cfg.Folders = make([]stconfig.FolderConfiguration, len(w.Raw().Folders))
-	for i, fldr := range w.Raw().Folders {
+	cfg.Folders = make([]stconfig.FolderConfiguration, len(raw.Folders))
+	for i, fldr := range raw.Folders {
 		cfg.Folders[i].ID = fldr.ID
 		cfg.Folders[i].Devices = make([]stconfig.FolderDeviceConfiguration, len(fldr.Devices))
 		copy(cfg.Folders[i].Devices, fldr.Devices)
 	}
 
-	cfg.Devices = w.Raw().Devices
-	cfg.Options.ListenAddresses = w.Raw().Options.ListenAddress
-	cfg.Options.LocalAnnEnabled = w.Raw().Options.LocalAnnounceEnabled
-	cfg.Options.LocalAnnPort = w.Raw().Options.LocalAnnouncePort
-	cfg.Options.LocalAnnMCAddr = w.Raw().Options.LocalAnnounceMCAddr
-	cfg.Options.GlobalAnnEnabled = w.Raw().Options.GlobalAnnounceEnabled
-	cfg.Options.GlobalAnnServers = w.Raw().Options.GlobalAnnounceServers
-	cfg.Options.RelaysEnabled = w.Raw().Options.RelaysEnabled
-	cfg.Options.RelayReconnectIntervalM = w.Raw().Options.RelayReconnectIntervalM
-
-	return stconfig.Wrap("/shouldnotexist", cfg)
+	cfg.Devices = raw.Devices
+	cfg.Options.ListenAddresses = raw.Options.ListenAddress
+	cfg.Options.LocalAnnEnabled = raw.Options.LocalAnnounceEnabled
+	cfg.Options.LocalAnnPort = raw.Options.LocalAnnouncePort
+	cfg.Options.LocalAnnMCAddr = raw.Options.LocalAnnounceMCAddr
+	cfg.Options.GlobalAnnEnabled = raw.Options.GlobalAnnounceEnabled
+	cfg.Options.GlobalAnnServers = raw.Options.GlobalAnnounceServers
+	cfg.Options.RelaysEnabled = raw.Options.RelaysEnabled
+	cfg.Options.RelayReconnectIntervalM = raw.Options.RelayReconnectIntervalM
+
+	return cfg
+}
+
+// stCfgFollower keeps a Syncthing configuration wrapper up to date, so the
+// Syncthing services see added and removed devices and folders.
+type stCfgFollower struct {
+	stCfg *stconfig.Wrapper
+	myID  protocol.DeviceID
+}
+
+func (f *stCfgFollower) CommitConfiguration(from, to Configuration) bool {
+	f.stCfg.Replace(asStConfiguration(to, f.myID))
+	return true
 }
@@ -9,19 +9,32 @@ import (
 	"github.com/syncthing/syncthing/lib/sync"
 )
 
+// Committer is notified when the configuration is replaced.
+type Committer interface {
+	// CommitConfiguration applies the change. It returns false if a restart
+	// is required for the change to take full effect.
+	CommitConfiguration(from, to Configuration) bool
+}
+
 type Wrapper struct {
 	cfg  Configuration
 	path string
-	mut  sync.Mutex
+
+	subs            []Committer
+	requiresRestart bool
+
+	mut       sync.Mutex
+	commitMut sync.Mutex // serializes changes, including notifying subscribers
 }
 
 // Wrap wraps an existing Configuration structure and ties it to a file on
 // disk.
 func Wrap(path string, cfg Configuration) *Wrapper {
 	w := &Wrapper{
-		cfg:  cfg,
-		path: path,
-		mut:  sync.NewMutex(),
+		cfg:       cfg,
+		path:      path,
+		mut:       sync.NewMutex(),
+		commitMut: sync.NewMutex(),
 	}
 	return w
 }
@@ -120,22 +133,144 @@ func (w *Wrapper) SetFolder(fldCfg FolderConfiguration) {
 	}
 }
 
+// Subscribe registers the given Committer to be notified of configuration
+// changes made through Replace.
+func (w *Wrapper) Subscribe(c Committer) {
+	w.mut.Lock()
+	w.subs = append(w.subs, c)
+	w.mut.Unlock()
+}
+
 func (w *Wrapper) Replace(to Configuration) error {
+	w.commitMut.Lock()
+	defer w.commitMut.Unlock()
+
 	w.mut.Lock()
-	defer w.mut.Unlock()
+	from, subs, err := w.swapUnsafe(to)
+	w.mut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	w.notify(from, to, subs)
+	return nil
+}
+
+// Modify changes the configuration in place, without losing changes made
+// concurrently, and notifies subscribers like Replace. The folders and
+// devices handed to change are copies. If change returns false, the
+// configuration is left alone. change must not call back into the wrapper.
+func (w *Wrapper) Modify(change func(cfg *Configuration) bool) error {
+	w.commitMut.Lock()
+	defer w.commitMut.Unlock()
+
+	w.mut.Lock()
+	to := w.cfg
+	to.Folders = make([]FolderConfiguration, len(w.cfg.Folders))
+	copy(to.Folders, w.cfg.Folders)
+	to.Devices = make([]stconfig.DeviceConfiguration, len(w.cfg.Devices))
+	copy(to.Devices, w.cfg.Devices)
+	if false == change(&to) {
+		w.mut.Unlock()
+		return nil
+	}
+	from, subs, err := w.swapUnsafe(to)
+	w.mut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	w.notify(from, to, subs)
+	return nil
+}
+
+// notify tells subscribers about a change, without holding the lock, since
+// subscribers read the config.
+func (w *Wrapper) notify(from Configuration, to Configuration, subs []Committer) {
+	for _, sub := range subs {
+		if false == sub.CommitConfiguration(from, to) {
+			if debug {
+				l.Debugf("%v requires restart for config change", sub)
+			}
+			w.mut.Lock()
+			w.requiresRestart = true
+			w.mut.Unlock()
+		}
+	}
+}
 
+// swapUnsafe validates the new configuration and makes it current, returning
+// the previous one and the subscribers to notify.
+// requires mut before entry
+func (w *Wrapper) swapUnsafe(to Configuration) (Configuration, []Committer, error) {
 	// validate
+	if _, err := to.Options.GetCacheSizeBytes(); err != nil {
+		l.Debugln("rejected config, cannot parse global cache size:", err)
+		return Configuration{}, nil, err
+	}
+	if _, _, err := to.Options.GetReadAheadLimits(); err != nil {
+		l.Debugln("rejected config, cannot parse read-ahead limits:", err)
+		return Configuration{}, nil, err
+	}
+	if _, err := to.Options.GetPinSchedule(); err != nil {
+		l.Debugln("rejected config, cannot parse pin schedule:", err)
+		return Configuration{}, nil, err
+	}
+	if _, _, err := to.Options.GetMeteredNetworks(); err != nil {
+		l.Debugln("rejected config, cannot parse metered networks:", err)
+		return Configuration{}, nil, err
+	}
+	if err := to.CheckMountPoints(); err != nil {
+		l.Debugln("rejected config, bad mount points:", err)
+		return Configuration{}, nil, err
+	}
 	for _, fldrCfg := range to.Folders {
 		if _, err := fldrCfg.GetCacheSizeBytes(); err != nil {
 			l.Debugln("rejected config, cannot parse cache size:", err)
-			return err
+			return Configuration{}, nil, err
+		}
+		if _, err := fldrCfg.GetCacheMinimumBytes(); err != nil {
+			l.Debugln("rejected config, cannot parse cache minimum:", err)
+			return Configuration{}, nil, err
+		}
+		if _, err := fldrCfg.GetCacheMaximumBytes(); err != nil {
+			l.Debugln("rejected config, cannot parse cache maximum:", err)
+			return Configuration{}, nil, err
+		}
+		if _, err := fldrCfg.GetCachePolicy(); err != nil {
+			l.Debugln("rejected config, unknown cache policy:", fldrCfg.CachePolicy)
+			return Configuration{}, nil, err
+		}
+		if _, err := fldrCfg.GetPrefetchBytes(); err != nil {
+			l.Debugln("rejected config, cannot parse prefetch bytes:", err)
+			return Configuration{}, nil, err
+		}
+		if _, err := fldrCfg.GetPrefetchOrder(); err != nil {
+			l.Debugln("rejected config, unknown prefetch order:", fldrCfg.PrefetchOrder)
+			return Configuration{}, nil, err
+		}
+		if _, _, err := fldrCfg.GetOwnership(); err != nil {
+			l.Debugln("rejected config, cannot resolve owner or group:", err)
+			return Configuration{}, nil, err
 		}
 	}
 
 	// set
+	from := w.cfg
 	w.cfg = to
+	subs := make([]Committer, len(w.subs))
+	copy(subs, w.subs)
 
-	return nil
+	return from, subs, nil
+}
+
+// RequiresRestart returns true if a change since startup could not be
+// applied without a restart.
+func (w *Wrapper) RequiresRestart() bool {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	return w.requiresRestart
 }
 
 // Save writes the configuration to disk
@@ -0,0 +1,132 @@
+package fileblockcache
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/burkemw3/syncthingfuse/lib/config"
+)
+
+// CacheBudget bounds the bytes cached by several folders together. When the
+// budget is exhausted, blocks are evicted from the folder furthest above its
+// minimum share.
+//
+// A budget and its caches share one bolt database. Their state is only
+// touched inside write transactions, which bolt serializes.
+type CacheBudget struct {
+	db                 *bolt.DB
+	maximumBytesStored int64
+	caches             map[string]*FileBlockCache
+}
+
+func NewCacheBudget(db *bolt.DB, maximumBytesStored int64) *CacheBudget {
+	l.Infoln("Global cache with", maximumBytesStored, "bytes")
+
+	return &CacheBudget{
+		db:                 db,
+		maximumBytesStored: maximumBytesStored,
+		caches:             make(map[string]*FileBlockCache),
+	}
+}
+
+// Resize changes the maximum size of the budget, evicting blocks if it
+// shrinks. Folder limits are capped again by FileBlockCache.Configure.
+func (b *CacheBudget) Resize(maximumBytesStored int64) {
+	b.db.Update(func(tx *bolt.Tx) error {
+		l.Infoln("Global cache resized from", b.maximumBytesStored, "to", maximumBytesStored, "bytes")
+
+		b.maximumBytesStored = maximumBytesStored
+		b.evictForSizeUnsafe(tx, nil, 0)
+
+		return nil
+	})
+}
+
+// MaximumBytes returns the most bytes all caches may hold together.
+func (b *CacheBudget) MaximumBytes() int64 {
+	return b.maximumBytesStored
+}
+
+// Remove stops the cache of a folder from drawing on the budget.
+func (b *CacheBudget) Remove(folder string) {
+	b.db.Update(func(tx *bolt.Tx) error {
+		delete(b.caches, folder)
+		return nil
+	})
+}
+
+// limits returns the minimum and maximum bytes a folder may keep within the
+// budget.
+func (b *CacheBudget) limits(fldrCfg config.FolderConfiguration) (int64, int64, error) {
+	minimum, err := fldrCfg.GetCacheMinimumBytes()
+	if err != nil {
+		return 0, 0, err
+	}
+	maximum, err := fldrCfg.GetCacheMaximumBytes()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if maximum == 0 || maximum > b.maximumBytesStored {
+		maximum = b.maximumBytesStored
+	}
+	if minimum > maximum {
+		minimum = maximum
+	}
+
+	return minimum, maximum, nil
+}
+
+func (b *CacheBudget) currentBytesStoredUnsafe() int64 {
+	var total int64
+	for _, d := range b.caches {
+		total += d.currentBytesStored
+	}
+	return total
+}
+
+// evictForSizeUnsafe makes room for blockSize bytes requested by requester,
+// which may be nil.
+func (b *CacheBudget) evictForSizeUnsafe(tx *bolt.Tx, requester *FileBlockCache, blockSize int64) {
+	for b.currentBytesStoredUnsafe()+blockSize > b.maximumBytesStored {
+		victim := b.victimUnsafe(requester)
+		if victim == nil {
+			return
+		}
+
+		folderBucket := tx.Bucket(victim.folderBucketKey)
+		cfb := folderBucket.Bucket(cachedFilesBucket)
+		pbb := folderBucket.Bucket(pinnedBlocksBucket)
+		gbb := folderBucket.Bucket(ghostBlocksBucket)
+		victim.evictOneUnsafe(cfb, pbb, gbb)
+	}
+}
+
+// victimUnsafe picks the cache to evict from: the one furthest above its
+// minimum, else the requester, else the largest one.
+func (b *CacheBudget) victimUnsafe(requester *FileBlockCache) *FileBlockCache {
+	var victim *FileBlockCache
+	var victimExcess int64
+	for _, d := range b.caches {
+		excess := d.currentBytesStored - d.minimumBytesStored
+		if false == d.policy.isEmpty() && excess > victimExcess {
+			victim = d
+			victimExcess = excess
+		}
+	}
+	if victim != nil {
+		return victim
+	}
+
+	if requester != nil && false == requester.policy.isEmpty() {
+		return requester
+	}
+
+	for _, d := range b.caches {
+		if d.policy.isEmpty() {
+			continue
+		}
+		if victim == nil || d.currentBytesStored > victim.currentBytesStored {
+			victim = d
+		}
+	}
+	return victim
+}
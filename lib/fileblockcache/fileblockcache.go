@@ -3,7 +3,9 @@ package fileblockcache
 import (
 	"bytes"
 	b64 "encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -19,39 +21,59 @@ type FileBlockCache struct {
 	folder          string
 	folderBucketKey []byte
 
-	maximumBytesStored int32
-	currentBytesStored int32
-	mostRecentlyUsed   []byte
-	leastRecentlyUsed  []byte
+	budget             *CacheBudget // shared with other folders, if configured
+	minimumBytesStored int64        // only meaningful with a budget
+	maximumBytesStored int64
+	currentBytesStored int64
+	policy             evictionPolicy
 }
 
 var (
 	cachedFilesBucket  = []byte("cachedFiles")
 	pinnedBlocksBucket = []byte("pinnedBlocks")
+	ghostBlocksBucket  = []byte("ghostBlocks")
+	cacheVersionKey    = []byte("cacheVersion")
+	cachePolicyKey     = []byte("cachePolicy")
+)
+
+const (
+	// 0: entry sizes stored as int32
+	// 1: entry sizes stored as int64
+	currentCacheVersion = 1
 )
 
 type fileCacheEntry struct {
 	Hash     []byte
 	Previous []byte
 	Next     []byte
-	Size     int32
+	Size     int64
+	Queue    int // of the eviction policy
 }
 
 func NewFileBlockCache(cfg *config.Wrapper, db *bolt.DB, fldrCfg config.FolderConfiguration) (*FileBlockCache, error) {
+	return NewSharedFileBlockCache(cfg, db, fldrCfg, nil)
+}
+
+// NewSharedFileBlockCache creates a cache that draws on the given budget,
+// instead of the cache size of the folder. The budget may be nil.
+func NewSharedFileBlockCache(cfg *config.Wrapper, db *bolt.DB, fldrCfg config.FolderConfiguration, budget *CacheBudget) (*FileBlockCache, error) {
 	d := &FileBlockCache{
 		cfg:             cfg,
 		db:              db,
 		folder:          fldrCfg.ID,
 		folderBucketKey: []byte(fldrCfg.ID),
+		budget:          budget,
 	}
 
-	cfgBytes, err := fldrCfg.GetCacheSizeBytes()
+	err := d.setLimits(fldrCfg)
+	if err != nil {
+		return nil, err
+	}
+	policyName, err := fldrCfg.GetCachePolicy()
 	if err != nil {
-		l.Warnln("Cannot parse cache size (", fldrCfg.CacheSize, ") for folder", fldrCfg.ID)
+		l.Warnln("Unknown cache policy (", fldrCfg.CachePolicy, ") for folder", fldrCfg.ID)
 		return nil, err
 	}
-	d.maximumBytesStored = cfgBytes
-	l.Infoln("Folder", d.folder, "with cache", d.maximumBytesStored, "bytes")
 
 	d.db.Update(func(tx *bolt.Tx) error {
 		// create buckets
@@ -70,21 +92,30 @@ func NewFileBlockCache(cfg *config.Wrapper, db *bolt.DB, fldrCfg config.FolderCo
 			l.Warnln("error creating pinned block bucket for folder", d.folder, err)
 			return err
 		}
+		gbb, err := b.CreateBucketIfNotExists(ghostBlocksBucket)
+		if err != nil {
+			l.Warnln("error creating ghost block bucket for folder", d.folder, err)
+			return err
+		}
+
+		err = d.migrateUnsafe(b, cfb, pbb)
+		if err != nil {
+			l.Warnln("error migrating cache for folder", d.folder, err)
+			return err
+		}
 
 		// update in-memory data cache
+		err = d.loadPolicyUnsafe(b, cfb, gbb, policyName)
+		if err != nil {
+			l.Warnln("error loading cache policy for folder", d.folder, err)
+			return err
+		}
 		cfb.ForEach(func(k, v []byte) error {
 			buf := bytes.NewBuffer(v)
 			dec := gob.NewDecoder(buf)
 			var focus fileCacheEntry
 			dec.Decode(&focus)
 
-			if focus.Previous == nil {
-				d.mostRecentlyUsed = focus.Hash
-			}
-			if focus.Next == nil {
-				d.leastRecentlyUsed = focus.Hash
-			}
-
 			_, pinned := getEntryUnsafely(pbb, focus.Hash)
 			if false == pinned {
 				d.currentBytesStored += focus.Size
@@ -93,8 +124,12 @@ func NewFileBlockCache(cfg *config.Wrapper, db *bolt.DB, fldrCfg config.FolderCo
 			return nil
 		})
 
+		if d.budget != nil {
+			d.budget.caches[d.folder] = d
+		}
+
 		// evict, in case cache size has decreased
-		d.evictForSizeUnsafe(cfb, pbb, 0)
+		d.evictForSizeUnsafe(cfb, pbb, gbb, 0)
 
 		return nil
 	})
@@ -105,6 +140,70 @@ func NewFileBlockCache(cfg *config.Wrapper, db *bolt.DB, fldrCfg config.FolderCo
 	return d, nil
 }
 
+// Configure applies the cache limits and policy of the folder configuration,
+// evicting blocks if the limits shrink.
+func (d *FileBlockCache) Configure(fldrCfg config.FolderConfiguration) error {
+	policyName, err := fldrCfg.GetCachePolicy()
+	if err != nil {
+		return err
+	}
+
+	d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(d.folderBucketKey)
+		cfb := b.Bucket(cachedFilesBucket)
+		pbb := b.Bucket(pinnedBlocksBucket)
+		gbb := b.Bucket(ghostBlocksBucket)
+
+		err = d.setLimits(fldrCfg)
+		if err != nil {
+			return err
+		}
+		if policyName != d.policy.name() {
+			err = d.loadPolicyUnsafe(b, cfb, gbb, policyName)
+			if err != nil {
+				return err
+			}
+		}
+		d.evictForSizeUnsafe(cfb, pbb, gbb, 0)
+
+		return nil
+	})
+	return err
+}
+
+func (d *FileBlockCache) setLimits(fldrCfg config.FolderConfiguration) error {
+	if d.budget == nil {
+		cfgBytes, err := fldrCfg.GetCacheSizeBytes()
+		if err != nil {
+			l.Warnln("Cannot parse cache size (", fldrCfg.CacheSize, ") for folder", fldrCfg.ID)
+			return err
+		}
+		d.maximumBytesStored = cfgBytes
+		l.Infoln("Folder", d.folder, "with cache", d.maximumBytesStored, "bytes")
+		return nil
+	}
+
+	minimum, maximum, err := d.budget.limits(fldrCfg)
+	if err != nil {
+		l.Warnln("Cannot parse cache limits (", fldrCfg.CacheMinimum, ",", fldrCfg.CacheMaximum, ") for folder", fldrCfg.ID)
+		return err
+	}
+	d.minimumBytesStored = minimum
+	d.maximumBytesStored = maximum
+	l.Infoln("Folder", d.folder, "with shared cache between", d.minimumBytesStored, "and", d.maximumBytesStored, "bytes")
+	return nil
+}
+
+// CachedBytes returns the bytes cached, not counting pinned blocks.
+func (d *FileBlockCache) CachedBytes() int64 {
+	return d.currentBytesStored
+}
+
+// MaximumBytes returns the most bytes the cache may hold.
+func (d *FileBlockCache) MaximumBytes() int64 {
+	return d.maximumBytesStored
+}
+
 func (d *FileBlockCache) PinExistingBlock(block protocol.BlockInfo) {
 	if debug {
 		blockHashString := b64.URLEncoding.EncodeToString(block.Hash)
@@ -114,13 +213,18 @@ func (d *FileBlockCache) PinExistingBlock(block protocol.BlockInfo) {
 	d.db.Update(func(tx *bolt.Tx) error {
 		pbb := tx.Bucket(d.folderBucketKey).Bucket(pinnedBlocksBucket)
 
+		if _, pinned := getEntryUnsafely(pbb, block.Hash); pinned {
+			// pinned for another file already
+			return nil
+		}
+
 		entry := fileCacheEntry{
 			Hash: block.Hash,
-			Size: block.Size,
+			Size: int64(block.Size),
 		}
 		setEntryUnsafely(pbb, entry)
 
-		d.currentBytesStored -= block.Size
+		d.currentBytesStored -= int64(block.Size)
 
 		return nil
 	})
@@ -136,6 +240,11 @@ func (d *FileBlockCache) PinNewBlock(block protocol.BlockInfo, data []byte) {
 		pbb := tx.Bucket(d.folderBucketKey).Bucket(pinnedBlocksBucket)
 		cfb := tx.Bucket(d.folderBucketKey).Bucket(cachedFilesBucket)
 
+		if _, pinned := getEntryUnsafely(pbb, block.Hash); pinned {
+			// pinned for another file already
+			return nil
+		}
+
 		_, found := getEntryUnsafely(cfb, block.Hash)
 		if false == found {
 			// save to disk
@@ -146,12 +255,12 @@ func (d *FileBlockCache) PinNewBlock(block protocol.BlockInfo, data []byte) {
 				return err // TODO error handle
 			}
 		} else {
-			d.currentBytesStored -= block.Size
+			d.currentBytesStored -= int64(block.Size)
 		}
 
 		entry := fileCacheEntry{
 			Hash: block.Hash,
-			Size: block.Size,
+			Size: int64(block.Size),
 		}
 		setEntryUnsafely(pbb, entry)
 
@@ -180,13 +289,14 @@ func (d *FileBlockCache) UnpinBlock(blockHash []byte) {
 	d.db.Update(func(tx *bolt.Tx) error {
 		pbb := tx.Bucket(d.folderBucketKey).Bucket(pinnedBlocksBucket)
 		cfb := tx.Bucket(d.folderBucketKey).Bucket(cachedFilesBucket)
+		gbb := tx.Bucket(d.folderBucketKey).Bucket(ghostBlocksBucket)
 
 		entry, pinned := getEntryUnsafely(pbb, blockHash)
 		if pinned {
 			_, found := getEntryUnsafely(cfb, blockHash)
 			if found {
 				d.currentBytesStored += entry.Size
-				d.evictForSizeUnsafe(cfb, pbb, 0)
+				d.evictForSizeUnsafe(cfb, pbb, gbb, 0)
 			} else {
 				// delete from disk
 				diskCachePath := getDiskCachePath(d.cfg, d.folder, blockHash)
@@ -217,73 +327,74 @@ func (d *FileBlockCache) HasCachedBlockData(blockHash []byte) bool {
 	return found
 }
 
-func (d *FileBlockCache) GetCachedBlockData(blockHash []byte) ([]byte, bool) {
-	found := false
-	var current, previous, next fileCacheEntry
-	var data []byte
+// HasAllBlocks returns true if every block is cached or pinned, checking
+// them in one transaction.
+func (d *FileBlockCache) HasAllBlocks(blocks []protocol.BlockInfo) bool {
+	found := true
 
-	d.db.Update(func(tx *bolt.Tx) error {
+	d.db.View(func(tx *bolt.Tx) error {
 		cfb := tx.Bucket(d.folderBucketKey).Bucket(cachedFilesBucket)
 		pbb := tx.Bucket(d.folderBucketKey).Bucket(pinnedBlocksBucket)
 
-		/* get nodes */
-		// current
-		current, found = getEntryUnsafely(cfb, blockHash)
-		if false == found {
-			current, found = getEntryUnsafely(pbb, blockHash)
-			if found {
-				if debug {
-					blockHashString := b64.URLEncoding.EncodeToString(blockHash)
-					l.Debugln("pinned block hit", blockHashString)
-				}
-				d.addAsMruUnsafe(cfb, current.Hash, current.Size)
-
-				diskCachePath := getDiskCachePath(d.cfg, d.folder, blockHash)
-				data, _ = ioutil.ReadFile(diskCachePath) // TODO check error
+		for _, block := range blocks {
+			if cfb.Get(block.Hash) == nil && pbb.Get(block.Hash) == nil {
+				found = false
+				return nil
 			}
-			return nil
 		}
-		found = true
 
-		// previous
-		if current.Previous != nil {
-			previous, _ = getEntryUnsafely(cfb, current.Previous)
-		}
+		return nil
+	})
 
-		// next
-		if current.Next != nil {
-			next, _ = getEntryUnsafely(cfb, current.Next)
-		}
+	return found
+}
 
-		/* manipulate LRU cache */
-		if false == bytes.Equal(blockHash, d.mostRecentlyUsed) {
-			if nil == current.Previous {
-				l.Warnln("broken LRU. no previous node for", b64.URLEncoding.EncodeToString(blockHash), "but not at MRU either", b64.URLEncoding.EncodeToString(d.mostRecentlyUsed))
-			}
+// HasPinnedBlocks returns true if every block is pinned, checking them in
+// one transaction.
+func (d *FileBlockCache) HasPinnedBlocks(blocks []protocol.BlockInfo) bool {
+	found := true
 
-			// remove current node
-			previous.Next = next.Hash
-			setEntryUnsafely(cfb, previous)
+	d.db.View(func(tx *bolt.Tx) error {
+		pbb := tx.Bucket(d.folderBucketKey).Bucket(pinnedBlocksBucket)
 
-			if current.Next != nil {
-				next.Previous = previous.Hash
-				setEntryUnsafely(cfb, next)
-			} else {
-				d.leastRecentlyUsed = previous.Hash
+		for _, block := range blocks {
+			if pbb.Get(block.Hash) == nil {
+				found = false
+				return nil
 			}
+		}
+
+		return nil
+	})
+
+	return found
+}
+
+func (d *FileBlockCache) GetCachedBlockData(blockHash []byte) ([]byte, bool) {
+	data, found := d.ReadCachedBlockData(blockHash)
+	if found {
+		d.TouchBlock(blockHash)
+	}
+	return data, found
+}
+
+// ReadCachedBlockData returns the data of a cached or pinned block, without
+// marking it as used, so it only needs a read transaction.
+func (d *FileBlockCache) ReadCachedBlockData(blockHash []byte) ([]byte, bool) {
+	found := false
+	var data []byte
 
-			// add current node at front
-			oldMru, _ := getEntryUnsafely(cfb, d.mostRecentlyUsed)
-			oldMru.Previous = current.Hash
-			setEntryUnsafely(cfb, oldMru)
+	d.db.View(func(tx *bolt.Tx) error {
+		cfb := tx.Bucket(d.folderBucketKey).Bucket(cachedFilesBucket)
+		pbb := tx.Bucket(d.folderBucketKey).Bucket(pinnedBlocksBucket)
 
-			current.Next = oldMru.Hash
-			current.Previous = nil
-			setEntryUnsafely(cfb, current)
-			d.mostRecentlyUsed = current.Hash
+		if _, found = getEntryUnsafely(cfb, blockHash); false == found {
+			_, found = getEntryUnsafely(pbb, blockHash)
+		}
+		if false == found {
+			return nil
 		}
 
-		/* get cached data */
 		diskCachePath := getDiskCachePath(d.cfg, d.folder, blockHash)
 		data, _ = ioutil.ReadFile(diskCachePath) // TODO check error
 
@@ -306,19 +417,51 @@ func (d *FileBlockCache) GetCachedBlockData(blockHash []byte) ([]byte, bool) {
 	return []byte(""), false
 }
 
+// TouchBlock marks a cached or pinned block as just used, for the eviction
+// policy. Blocks no longer stored are left alone.
+func (d *FileBlockCache) TouchBlock(blockHash []byte) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		cfb := tx.Bucket(d.folderBucketKey).Bucket(cachedFilesBucket)
+		pbb := tx.Bucket(d.folderBucketKey).Bucket(pinnedBlocksBucket)
+		gbb := tx.Bucket(d.folderBucketKey).Bucket(ghostBlocksBucket)
+
+		if current, found := getEntryUnsafely(cfb, blockHash); found {
+			d.policy.touchUnsafe(cfb, current)
+			return nil
+		}
+
+		if current, found := getEntryUnsafely(pbb, blockHash); found {
+			if debug {
+				blockHashString := b64.URLEncoding.EncodeToString(blockHash)
+				l.Debugln("pinned block hit", blockHashString)
+			}
+			d.policy.addUnsafe(cfb, gbb, fileCacheEntry{Hash: current.Hash, Size: current.Size})
+		}
+
+		return nil
+	})
+}
+
 func (d *FileBlockCache) AddCachedFileData(block protocol.BlockInfo, data []byte) {
 	d.db.Update(func(tx *bolt.Tx) error {
 		cfb := tx.Bucket(d.folderBucketKey).Bucket(cachedFilesBucket)
 		pbb := tx.Bucket(d.folderBucketKey).Bucket(pinnedBlocksBucket)
+		gbb := tx.Bucket(d.folderBucketKey).Bucket(ghostBlocksBucket)
 
 		if debug {
 			l.Debugln("Putting block", b64.URLEncoding.EncodeToString(block.Hash), "with", block.Size, "bytes. max bytes", d.maximumBytesStored)
 		}
 
-		d.evictForSizeUnsafe(cfb, pbb, block.Size)
+		if current, found := getEntryUnsafely(cfb, block.Hash); found {
+			// fetched twice concurrently, keep the first copy
+			d.policy.touchUnsafe(cfb, current)
+			return nil
+		}
+
+		d.evictForSizeUnsafe(cfb, pbb, gbb, int64(block.Size))
 
-		d.addAsMruUnsafe(cfb, block.Hash, block.Size)
-		d.currentBytesStored += block.Size
+		d.policy.addUnsafe(cfb, gbb, fileCacheEntry{Hash: block.Hash, Size: int64(block.Size)})
+		d.currentBytesStored += int64(block.Size)
 
 		// write block data to disk
 		diskCachePath := getDiskCachePath(d.cfg, d.folder, block.Hash)
@@ -332,55 +475,119 @@ func (d *FileBlockCache) AddCachedFileData(block protocol.BlockInfo, data []byte
 	})
 }
 
-func (d *FileBlockCache) addAsMruUnsafe(cfb *bolt.Bucket, hash []byte, size int32) {
-	current := fileCacheEntry{
-		Hash: hash,
-		Next: d.mostRecentlyUsed,
-		Size: size,
+func (d *FileBlockCache) evictForSizeUnsafe(cfb *bolt.Bucket, pbb *bolt.Bucket, gbb *bolt.Bucket, blockSize int64) {
+	for d.currentBytesStored+blockSize > d.maximumBytesStored && false == d.policy.isEmpty() {
+		d.evictOneUnsafe(cfb, pbb, gbb)
 	}
-	if d.mostRecentlyUsed != nil {
-		oldMru, _ := getEntryUnsafely(cfb, d.mostRecentlyUsed)
-		oldMru.Previous = current.Hash
-		setEntryUnsafely(cfb, oldMru)
+
+	if d.budget != nil {
+		d.budget.evictForSizeUnsafe(cfb.Tx(), d, blockSize)
+	}
+}
+
+// evictOneUnsafe evicts the block chosen by the eviction policy.
+func (d *FileBlockCache) evictOneUnsafe(cfb *bolt.Bucket, pbb *bolt.Bucket, gbb *bolt.Bucket) {
+	victim, found := d.policy.evictUnsafe(cfb, gbb, d.maximumBytesStored)
+	if false == found {
+		return
+	}
+
+	// remove from db
+	cfb.Delete(victim.Hash)
+
+	// remove from disk if not pinned
+	_, pinned := getEntryUnsafely(pbb, victim.Hash)
+	if false == pinned {
+		diskCachePath := getDiskCachePath(d.cfg, d.folder, victim.Hash)
+		os.Remove(diskCachePath)
 	}
-	setEntryUnsafely(cfb, current)
-	d.mostRecentlyUsed = current.Hash
 
-	if d.leastRecentlyUsed == nil {
-		d.leastRecentlyUsed = current.Hash
+	d.currentBytesStored -= victim.Size
+
+	if debug {
+		l.Debugln("Evicted", b64.URLEncoding.EncodeToString(victim.Hash), "for", victim.Size, "bytes. currently stored", d.currentBytesStored)
 	}
 }
 
-func (d *FileBlockCache) evictForSizeUnsafe(cfb *bolt.Bucket, pbb *bolt.Bucket, blockSize int32) {
-	for d.currentBytesStored+blockSize > d.maximumBytesStored && d.leastRecentlyUsed != nil {
-		// evict LRU
-		victim, _ := getEntryUnsafely(cfb, d.leastRecentlyUsed)
-		d.leastRecentlyUsed = victim.Previous
+// loadPolicyUnsafe rebuilds the eviction policy from the stored entries. If
+// the policy has changed, cached blocks are queued afresh, losing their
+// recency.
+func (d *FileBlockCache) loadPolicyUnsafe(b *bolt.Bucket, cfb *bolt.Bucket, gbb *bolt.Bucket, policyName string) error {
+	d.policy = newEvictionPolicy(policyName)
 
-		if victim.Previous == nil {
-			d.mostRecentlyUsed = nil
-		} else {
-			previous, _ := getEntryUnsafely(cfb, victim.Previous)
-			previous.Next = nil
-			setEntryUnsafely(cfb, previous)
-		}
+	storedName := config.CachePolicyLRU
+	if v := b.Get(cachePolicyKey); v != nil {
+		storedName = string(v)
+	}
 
-		// remove from db
-		cfb.Delete(victim.Hash)
+	entries := make([]fileCacheEntry, 0)
+	cfb.ForEach(func(k, v []byte) error {
+		entry, _ := getEntryUnsafely(cfb, k)
+		entries = append(entries, entry)
+		return nil
+	})
 
-		// remove from disk if not pinned
-		_, pinned := getEntryUnsafely(pbb, victim.Hash)
-		if false == pinned {
-			diskCachePath := getDiskCachePath(d.cfg, d.folder, victim.Hash)
-			os.Remove(diskCachePath)
+	if storedName == d.policy.name() {
+		for _, entry := range entries {
+			d.policy.loadUnsafe(entry, false)
 		}
+		return gbb.ForEach(func(k, v []byte) error {
+			entry, _ := getEntryUnsafely(gbb, k)
+			d.policy.loadUnsafe(entry, true)
+			return nil
+		})
+	}
 
-		d.currentBytesStored -= victim.Size
+	l.Infoln("Folder", d.folder, "changing cache policy from", storedName, "to", d.policy.name())
 
-		if debug {
-			l.Debugln("Evicted", b64.URLEncoding.EncodeToString(victim.Hash), "for", victim.Size, "bytes. currently stored", d.currentBytesStored)
+	ghosts := make([][]byte, 0)
+	gbb.ForEach(func(k, v []byte) error {
+		ghosts = append(ghosts, k)
+		return nil
+	})
+	for _, ghost := range ghosts {
+		gbb.Delete(ghost)
+	}
+
+	for _, entry := range entries {
+		d.policy.addUnsafe(cfb, gbb, entry)
+	}
+
+	return b.Put(cachePolicyKey, []byte(d.policy.name()))
+}
+
+// migrateUnsafe brings the cache entries of a folder up to the current
+// version. Gob decodes sizes written as int32 into int64 fields, so entries
+// are re-encoded with their 64-bit sizes.
+func (d *FileBlockCache) migrateUnsafe(b *bolt.Bucket, cfb *bolt.Bucket, pbb *bolt.Bucket) error {
+	version := 0
+	if v := b.Get(cacheVersionKey); v != nil {
+		version = int(binary.BigEndian.Uint64(v))
+	}
+
+	if version >= currentCacheVersion {
+		return nil
+	}
+
+	if debug {
+		l.Debugln("Migrating cache for folder", d.folder, "from version", version, "to", currentCacheVersion)
+	}
+
+	for _, bucket := range []*bolt.Bucket{cfb, pbb} {
+		entries := make([]fileCacheEntry, 0)
+		bucket.ForEach(func(k, v []byte) error {
+			entry, _ := getEntryUnsafely(bucket, k)
+			entries = append(entries, entry)
+			return nil
+		})
+		for _, entry := range entries {
+			setEntryUnsafely(bucket, entry)
 		}
 	}
+
+	versionBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(versionBytes, currentCacheVersion)
+	return b.Put(cacheVersionKey, versionBytes)
 }
 
 func GetDiskCacheBasePath(cfg *config.Wrapper, folder string) string {
@@ -418,13 +625,13 @@ func (d *FileBlockCache) logCacheEntries() {
 			cfb := tx.Bucket(d.folderBucketKey).Bucket(cachedFilesBucket)
 
 			hashes := make([]string, 0)
-			entry, found := getEntryUnsafely(cfb, d.mostRecentlyUsed)
-			for found {
-				hashes = append(hashes, string(entry.Hash))
-				entry, found = getEntryUnsafely(cfb, entry.Next)
-			}
+			cfb.ForEach(func(k, v []byte) error {
+				entry, _ := getEntryUnsafely(cfb, k)
+				hashes = append(hashes, fmt.Sprintf("%s@%d", entry.Hash, entry.Queue))
+				return nil
+			})
 
-			l.Debugln("MRU to LRU", hashes)
+			l.Debugln("cached blocks with", d.policy.name(), "queues", hashes)
 
 			return nil
 		})
@@ -1,6 +1,10 @@
 package fileblockcache
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -111,6 +115,37 @@ func TestBlockGetsEvicted2(t *testing.T) {
 	assertAvailable(t, fbc, block3.Hash, data3)
 }
 
+func TestReadLeavesOrderUntilTouched(t *testing.T) {
+	cfg, db, fldrCfg := setup(t, "2b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	fbc, _ := NewFileBlockCache(cfg, db, fldrCfg)
+
+	data1 := []byte("data1")
+	block1 := protocol.BlockInfo{Hash: []byte("hash1"), Size: 1}
+	fbc.AddCachedFileData(block1, data1)
+
+	data2 := []byte("data2")
+	block2 := protocol.BlockInfo{Hash: []byte("hash2"), Size: 1}
+	fbc.AddCachedFileData(block2, data2)
+
+	// reading alone keeps block1 the oldest
+	if data, found := fbc.ReadCachedBlockData(block1.Hash); false == found || false == bytes.Equal(data, data1) {
+		t.Error("expected block1 to be read, but got", found, data)
+	}
+	data3 := []byte("data3")
+	block3 := protocol.BlockInfo{Hash: []byte("hash3"), Size: 1}
+	fbc.AddCachedFileData(block3, data3)
+	assertUnavailable(t, fbc, block1.Hash)
+
+	// touching block2 makes block3 the oldest
+	fbc.TouchBlock(block2.Hash)
+	data4 := []byte("data4")
+	block4 := protocol.BlockInfo{Hash: []byte("hash4"), Size: 1}
+	fbc.AddCachedFileData(block4, data4)
+	assertUnavailable(t, fbc, block3.Hash)
+	assertAvailable(t, fbc, block2.Hash, data2)
+}
+
 func TestEvictMultipleBlocks(t *testing.T) {
 	cfg, db, fldrCfg := setup(t, "2b")
 	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
@@ -224,6 +259,24 @@ func TestPinNewBlockDespiteExistingStays(t *testing.T) {
 	assertAvailable(t, fbc, block3.Hash, data3)
 }
 
+func TestPinTwiceCountsOnce(t *testing.T) {
+	cfg, db, fldrCfg := setup(t, "2b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	fbc, _ := NewFileBlockCache(cfg, db, fldrCfg)
+
+	data1 := []byte("data1")
+	block1 := protocol.BlockInfo{Hash: []byte("hash1"), Size: 1}
+	fbc.AddCachedFileData(block1, data1)
+
+	fbc.PinExistingBlock(block1)
+	fbc.PinExistingBlock(block1)
+	fbc.PinNewBlock(block1, data1)
+
+	if fbc.currentBytesStored != 0 {
+		t.Error("expected pinned block to leave the cache once, but got", fbc.currentBytesStored, "bytes stored")
+	}
+}
+
 func TestPinStaysAfterUnpin(t *testing.T) {
 	cfg, db, fldrCfg := setup(t, "2b")
 	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
@@ -272,6 +325,228 @@ func TestPinLeavesAfterUnpin(t *testing.T) {
 	assertUnavailable(t, fbc, block1.Hash)
 }
 
+func TestCacheSizeBeyond32Bits(t *testing.T) {
+	cfg, db, fldrCfg := setup(t, "3GiB")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	fbc, err := NewFileBlockCache(cfg, db, fldrCfg)
+
+	if err != nil {
+		t.Fatal("cache should be created, but got", err)
+	}
+	if fbc.maximumBytesStored != 3*1024*1024*1024 {
+		t.Error("expected 3GiB maximum, but got", fbc.maximumBytesStored)
+	}
+}
+
+func TestMigrateInt32Entries(t *testing.T) {
+	// Arrange
+	cfg, db, fldrCfg := setup(t, "5b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	fbc, _ := NewFileBlockCache(cfg, db, fldrCfg)
+
+	data1 := []byte("data1")
+	block1 := protocol.BlockInfo{Hash: []byte("hash1"), Size: 1}
+	fbc.AddCachedFileData(block1, data1)
+	data2 := []byte("data2")
+	block2 := protocol.BlockInfo{Hash: []byte("hash2"), Size: 2}
+	fbc.AddCachedFileData(block2, data2)
+	data3 := []byte("data3")
+	block3 := protocol.BlockInfo{Hash: []byte("hash3"), Size: 3}
+	fbc.PinNewBlock(block3, data3)
+
+	// rewrite the entries as they were stored before sizes were 64-bit
+	type oldFileCacheEntry struct {
+		Hash     []byte
+		Previous []byte
+		Next     []byte
+		Size     int32
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(folder))
+		b.Delete(cacheVersionKey)
+
+		for _, bucket := range []*bolt.Bucket{b.Bucket(cachedFilesBucket), b.Bucket(pinnedBlocksBucket)} {
+			entries := make([]fileCacheEntry, 0)
+			bucket.ForEach(func(k, v []byte) error {
+				entry, _ := getEntryUnsafely(bucket, k)
+				entries = append(entries, entry)
+				return nil
+			})
+			for _, entry := range entries {
+				var buf bytes.Buffer
+				gob.NewEncoder(&buf).Encode(oldFileCacheEntry{
+					Hash:     entry.Hash,
+					Previous: entry.Previous,
+					Next:     entry.Next,
+					Size:     int32(entry.Size),
+				})
+				bucket.Put(entry.Hash, buf.Bytes())
+			}
+		}
+		return nil
+	})
+
+	// Act
+	fbc, _ = NewFileBlockCache(cfg, db, fldrCfg)
+
+	// Assert
+	if fbc.currentBytesStored != 3 {
+		t.Error("expected 3 bytes stored after migration, but got", fbc.currentBytesStored)
+	}
+	assertAvailable(t, fbc, block1.Hash, data1)
+	assertAvailable(t, fbc, block2.Hash, data2)
+	assertAvailable(t, fbc, block3.Hash, data3)
+	assertPin(t, fbc, block3.Hash, true)
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(folder))
+
+		v := b.Get(cacheVersionKey)
+		if v == nil || binary.BigEndian.Uint64(v) != currentCacheVersion {
+			t.Error("expected cache version", currentCacheVersion, "after migration, but got", v)
+		}
+
+		expected := []struct {
+			bucket []byte
+			block  protocol.BlockInfo
+		}{
+			{cachedFilesBucket, block1},
+			{cachedFilesBucket, block2},
+			{pinnedBlocksBucket, block3},
+		}
+		for _, e := range expected {
+			entry, found := getEntryUnsafely(b.Bucket(e.bucket), e.block.Hash)
+			if false == found || entry.Size != int64(e.block.Size) {
+				t.Error("expected", string(e.block.Hash), "migrated with size", e.block.Size, "but got", found, entry.Size)
+			}
+		}
+		return nil
+	})
+}
+
+func TestBudgetEvictsFromOtherFolders(t *testing.T) {
+	// Arrange
+	cfg, db, _ := setup(t, "1b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	budget := NewCacheBudget(db, 2)
+	idle := setupSharedCache(t, cfg, db, budget, "idle", "")
+	busy := setupSharedCache(t, cfg, db, budget, "busy", "")
+
+	idle.AddCachedFileData(protocol.BlockInfo{Hash: []byte("idle1"), Size: 1}, []byte("i"))
+	idle.AddCachedFileData(protocol.BlockInfo{Hash: []byte("idle2"), Size: 1}, []byte("i"))
+
+	// Act
+	busy.AddCachedFileData(protocol.BlockInfo{Hash: []byte("busy1"), Size: 1}, []byte("b"))
+
+	// Assert
+	assertUnavailable(t, idle, []byte("idle1"))
+	assertAvailable(t, idle, []byte("idle2"), []byte("i"))
+	assertAvailable(t, busy, []byte("busy1"), []byte("b"))
+}
+
+func TestBudgetKeepsFolderMinimum(t *testing.T) {
+	// Arrange
+	cfg, db, _ := setup(t, "1b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	budget := NewCacheBudget(db, 2)
+	idle := setupSharedCache(t, cfg, db, budget, "idle", "1b")
+	busy := setupSharedCache(t, cfg, db, budget, "busy", "")
+
+	idle.AddCachedFileData(protocol.BlockInfo{Hash: []byte("idle1"), Size: 1}, []byte("i"))
+	idle.AddCachedFileData(protocol.BlockInfo{Hash: []byte("idle2"), Size: 1}, []byte("i"))
+
+	// Act
+	busy.AddCachedFileData(protocol.BlockInfo{Hash: []byte("busy1"), Size: 1}, []byte("b"))
+	busy.AddCachedFileData(protocol.BlockInfo{Hash: []byte("busy2"), Size: 1}, []byte("b"))
+
+	// Assert
+	assertAvailable(t, idle, []byte("idle2"), []byte("i"))
+	assertUnavailable(t, busy, []byte("busy1"))
+	assertAvailable(t, busy, []byte("busy2"), []byte("b"))
+}
+
+func TestTwoQueueScanKeepsWorkingSet(t *testing.T) {
+	// Arrange
+	cfg, db, fldrCfg := setup(t, "8b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	fldrCfg.CachePolicy = config.CachePolicy2Q
+	fbc, _ := NewFileBlockCache(cfg, db, fldrCfg)
+
+	readWorkingSetTwice(fbc)
+
+	// Act
+	scan(fbc, 50)
+
+	// Assert
+	assertAvailable(t, fbc, []byte("hot1"), []byte("h"))
+	assertAvailable(t, fbc, []byte("hot2"), []byte("h"))
+}
+
+func TestLruScanEvictsWorkingSet(t *testing.T) {
+	// Arrange
+	cfg, db, fldrCfg := setup(t, "8b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	fbc, _ := NewFileBlockCache(cfg, db, fldrCfg)
+
+	readWorkingSetTwice(fbc)
+
+	// Act
+	scan(fbc, 50)
+
+	// Assert
+	assertUnavailable(t, fbc, []byte("hot1"))
+	assertUnavailable(t, fbc, []byte("hot2"))
+}
+
+func TestChangePolicyKeepsCachedBlocks(t *testing.T) {
+	// Arrange
+	cfg, db, fldrCfg := setup(t, "2b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	fbc, _ := NewFileBlockCache(cfg, db, fldrCfg)
+
+	data1 := []byte("data1")
+	block1 := protocol.BlockInfo{Hash: []byte("hash1"), Size: 1}
+	fbc.AddCachedFileData(block1, data1)
+	data2 := []byte("data2")
+	block2 := protocol.BlockInfo{Hash: []byte("hash2"), Size: 1}
+	fbc.AddCachedFileData(block2, data2)
+
+	// Act
+	fldrCfg.CachePolicy = config.CachePolicy2Q
+	fbc, _ = NewFileBlockCache(cfg, db, fldrCfg)
+
+	// Assert
+	assertAvailable(t, fbc, block1.Hash, data1)
+	assertAvailable(t, fbc, block2.Hash, data2)
+
+	data3 := []byte("data3")
+	block3 := protocol.BlockInfo{Hash: []byte("hash3"), Size: 1}
+	fbc.AddCachedFileData(block3, data3)
+	assertAvailable(t, fbc, block3.Hash, data3)
+	if fbc.currentBytesStored != 2 {
+		t.Error("expected 2 bytes stored, but got", fbc.currentBytesStored)
+	}
+}
+
+func TestConfigureReturnsLimitError(t *testing.T) {
+	// Arrange
+	cfg, db, fldrCfg := setup(t, "2b")
+	defer os.RemoveAll(path.Dir(cfg.ConfigPath()))
+	fbc, _ := NewFileBlockCache(cfg, db, fldrCfg)
+
+	// Act
+	fldrCfg.CacheSize = "lots"
+	err := fbc.Configure(fldrCfg)
+
+	// Assert
+	if err == nil {
+		t.Error("expected unparseable cache size to be an error")
+	}
+	if fbc.MaximumBytes() != 2 {
+		t.Error("expected 2 byte maximum to be kept, but got", fbc.MaximumBytes())
+	}
+}
+
 func assertAvailable(t *testing.T, fbc *FileBlockCache, hash []byte, expectedData []byte) {
 	actualData, found := fbc.GetCachedBlockData(hash)
 	if false == found {
@@ -302,6 +577,34 @@ func assertPin(t *testing.T, fbc *FileBlockCache, hash []byte, expected bool) {
 	}
 }
 
+// readThrough reads a block like the model does, adding it to the cache on
+// a miss.
+func readThrough(fbc *FileBlockCache, hash string, data string) {
+	if _, found := fbc.GetCachedBlockData([]byte(hash)); false == found {
+		block := protocol.BlockInfo{Hash: []byte(hash), Size: int32(len(data))}
+		fbc.AddCachedFileData(block, []byte(data))
+	}
+}
+
+// readWorkingSetTwice reads two hot blocks, pushes them out with other
+// reads, then reads them again.
+func readWorkingSetTwice(fbc *FileBlockCache) {
+	readThrough(fbc, "hot1", "h")
+	readThrough(fbc, "hot2", "h")
+	for i := 0; i < 8; i++ {
+		readThrough(fbc, fmt.Sprintf("other%d", i), "o")
+	}
+	readThrough(fbc, "hot1", "h")
+	readThrough(fbc, "hot2", "h")
+}
+
+// scan reads blocks once each, like grep -r through the mount.
+func scan(fbc *FileBlockCache, blocks int) {
+	for i := 0; i < blocks; i++ {
+		readThrough(fbc, fmt.Sprintf("scan%d", i), "s")
+	}
+}
+
 func setup(t *testing.T, cacheSize string) (*config.Wrapper, *bolt.DB, config.FolderConfiguration) {
 	dir, _ := ioutil.TempDir("", "stf-mt")
 	configFile, _ := ioutil.TempFile(dir, "config")
@@ -320,3 +623,18 @@ func setup(t *testing.T, cacheSize string) (*config.Wrapper, *bolt.DB, config.Fo
 
 	return cfg, database, folderCfg
 }
+
+func setupSharedCache(t *testing.T, cfg *config.Wrapper, db *bolt.DB, budget *CacheBudget, id string, minimum string) *FileBlockCache {
+	folderCfg := config.FolderConfiguration{
+		ID:           id,
+		CacheSize:    "1b",
+		CacheMinimum: minimum,
+	}
+	cfg.SetFolder(folderCfg)
+
+	fbc, err := NewSharedFileBlockCache(cfg, db, folderCfg, budget)
+	if err != nil {
+		t.Fatal("cache should be created, but got", err)
+	}
+	return fbc
+}
@@ -0,0 +1,216 @@
+package fileblockcache
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/burkemw3/syncthingfuse/lib/config"
+)
+
+// evictionPolicy decides which cached block to evict next. Policies keep
+// their queues as linked cache entries in bolt, with the ends of each queue
+// in memory.
+type evictionPolicy interface {
+	name() string
+	// loadUnsafe rebuilds in-memory state from a stored entry on startup
+	loadUnsafe(entry fileCacheEntry, ghost bool)
+	// addUnsafe records a block newly added to the cache
+	addUnsafe(cfb *bolt.Bucket, gbb *bolt.Bucket, entry fileCacheEntry)
+	// touchUnsafe records a hit on a cached block
+	touchUnsafe(cfb *bolt.Bucket, entry fileCacheEntry)
+	// evictUnsafe unlinks and returns the next block to evict
+	evictUnsafe(cfb *bolt.Bucket, gbb *bolt.Bucket, maximumBytesStored int64) (fileCacheEntry, bool)
+	isEmpty() bool
+}
+
+func newEvictionPolicy(name string) evictionPolicy {
+	switch name {
+	case config.CachePolicy2Q:
+		return &twoQueuePolicy{
+			in:    &blockQueue{id: twoQueueIn},
+			main:  &blockQueue{id: twoQueueMain},
+			ghost: &blockQueue{id: twoQueueGhost},
+		}
+	default:
+		return &lruPolicy{queue: &blockQueue{}}
+	}
+}
+
+// blockQueue is a doubly linked list of cache entries stored in a bolt
+// bucket. Several queues may share a bucket, since entries are keyed by
+// block hash and record the queue they are in.
+type blockQueue struct {
+	id   int
+	head []byte // most recently added
+	tail []byte // least recently added
+	size int64  // bytes of all entries in the queue
+}
+
+func (q *blockQueue) loadUnsafe(entry fileCacheEntry) {
+	if entry.Previous == nil {
+		q.head = entry.Hash
+	}
+	if entry.Next == nil {
+		q.tail = entry.Hash
+	}
+	q.size += entry.Size
+}
+
+func (q *blockQueue) pushFrontUnsafe(b *bolt.Bucket, entry fileCacheEntry) {
+	entry.Queue = q.id
+	entry.Previous = nil
+	entry.Next = q.head
+
+	if q.head != nil {
+		oldHead, _ := getEntryUnsafely(b, q.head)
+		oldHead.Previous = entry.Hash
+		setEntryUnsafely(b, oldHead)
+	}
+	setEntryUnsafely(b, entry)
+
+	q.head = entry.Hash
+	if q.tail == nil {
+		q.tail = entry.Hash
+	}
+	q.size += entry.Size
+}
+
+// unlinkUnsafe takes the entry out of the queue. The entry itself stays in
+// the bucket.
+func (q *blockQueue) unlinkUnsafe(b *bolt.Bucket, entry fileCacheEntry) {
+	if entry.Previous == nil {
+		q.head = entry.Next
+	} else {
+		previous, _ := getEntryUnsafely(b, entry.Previous)
+		previous.Next = entry.Next
+		setEntryUnsafely(b, previous)
+	}
+
+	if entry.Next == nil {
+		q.tail = entry.Previous
+	} else {
+		next, _ := getEntryUnsafely(b, entry.Next)
+		next.Previous = entry.Previous
+		setEntryUnsafely(b, next)
+	}
+
+	q.size -= entry.Size
+}
+
+func (q *blockQueue) moveToFrontUnsafe(b *bolt.Bucket, entry fileCacheEntry) {
+	q.unlinkUnsafe(b, entry)
+	q.pushFrontUnsafe(b, entry)
+}
+
+func (q *blockQueue) popBackUnsafe(b *bolt.Bucket) (fileCacheEntry, bool) {
+	if q.tail == nil {
+		return fileCacheEntry{}, false
+	}
+	entry, _ := getEntryUnsafely(b, q.tail)
+	q.unlinkUnsafe(b, entry)
+	return entry, true
+}
+
+// lruPolicy evicts the least recently used block.
+type lruPolicy struct {
+	queue *blockQueue
+}
+
+func (p *lruPolicy) name() string {
+	return config.CachePolicyLRU
+}
+
+func (p *lruPolicy) loadUnsafe(entry fileCacheEntry, ghost bool) {
+	if false == ghost {
+		p.queue.loadUnsafe(entry)
+	}
+}
+
+func (p *lruPolicy) addUnsafe(cfb *bolt.Bucket, gbb *bolt.Bucket, entry fileCacheEntry) {
+	p.queue.pushFrontUnsafe(cfb, entry)
+}
+
+func (p *lruPolicy) touchUnsafe(cfb *bolt.Bucket, entry fileCacheEntry) {
+	p.queue.moveToFrontUnsafe(cfb, entry)
+}
+
+func (p *lruPolicy) evictUnsafe(cfb *bolt.Bucket, gbb *bolt.Bucket, maximumBytesStored int64) (fileCacheEntry, bool) {
+	return p.queue.popBackUnsafe(cfb)
+}
+
+func (p *lruPolicy) isEmpty() bool {
+	return p.queue.tail == nil
+}
+
+const (
+	twoQueueMain = iota
+	twoQueueIn
+	twoQueueGhost
+)
+
+// twoQueuePolicy is the 2Q algorithm of Johnson and Shasha. New blocks enter
+// a FIFO queue, and are remembered in a ghost queue after eviction. Only
+// blocks added again while remembered enter the main LRU queue, so a single
+// pass over many files cannot flush the frequently used blocks.
+type twoQueuePolicy struct {
+	in    *blockQueue // FIFO of blocks seen once, A1in
+	main  *blockQueue // LRU of blocks seen again, Am
+	ghost *blockQueue // FIFO of hashes evicted from in, A1out
+}
+
+func (p *twoQueuePolicy) name() string {
+	return config.CachePolicy2Q
+}
+
+func (p *twoQueuePolicy) loadUnsafe(entry fileCacheEntry, ghost bool) {
+	switch {
+	case ghost:
+		p.ghost.loadUnsafe(entry)
+	case entry.Queue == twoQueueIn:
+		p.in.loadUnsafe(entry)
+	default:
+		p.main.loadUnsafe(entry)
+	}
+}
+
+func (p *twoQueuePolicy) addUnsafe(cfb *bolt.Bucket, gbb *bolt.Bucket, entry fileCacheEntry) {
+	if ghost, found := getEntryUnsafely(gbb, entry.Hash); found {
+		p.ghost.unlinkUnsafe(gbb, ghost)
+		gbb.Delete(ghost.Hash)
+		p.main.pushFrontUnsafe(cfb, entry)
+		return
+	}
+
+	p.in.pushFrontUnsafe(cfb, entry)
+}
+
+func (p *twoQueuePolicy) touchUnsafe(cfb *bolt.Bucket, entry fileCacheEntry) {
+	// hits in the FIFO queue are usually correlated, e.g. several reads of
+	// one block, so they don't count as reuse
+	if entry.Queue == twoQueueMain {
+		p.main.moveToFrontUnsafe(cfb, entry)
+	}
+}
+
+func (p *twoQueuePolicy) evictUnsafe(cfb *bolt.Bucket, gbb *bolt.Bucket, maximumBytesStored int64) (fileCacheEntry, bool) {
+	// the queue sizes recommended by the paper: a quarter of the cache for
+	// new blocks, and ghosts for half of the cache
+	if p.in.size <= maximumBytesStored/4 && p.main.tail != nil {
+		return p.main.popBackUnsafe(cfb)
+	}
+
+	victim, found := p.in.popBackUnsafe(cfb)
+	if false == found {
+		return p.main.popBackUnsafe(cfb)
+	}
+
+	p.ghost.pushFrontUnsafe(gbb, fileCacheEntry{Hash: victim.Hash, Size: victim.Size})
+	for p.ghost.size > maximumBytesStored/2 {
+		forgotten, _ := p.ghost.popBackUnsafe(gbb)
+		gbb.Delete(forgotten.Hash)
+	}
+
+	return victim, true
+}
+
+func (p *twoQueuePolicy) isEmpty() bool {
+	return p.in.tail == nil && p.main.tail == nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"sync"
 
 	"github.com/boltdb/bolt"
 	"github.com/burkemw3/syncthingfuse/lib/config"
@@ -17,20 +18,29 @@ type FileTreeCache struct {
 	db              *bolt.DB
 	folder          string
 	folderBucketKey []byte
+	localDevice     protocol.DeviceID
+
+	countsMut  sync.Mutex
+	totalBytes int64 // of all entries
+	totalFiles int64
+	generation uint64 // changes whenever entries do
 }
 
 var (
-	entriesBucket      = []byte("entries")
-	entryDevicesBucket = []byte("entryDevices") // devices that have the current version
-	childLookupBucket  = []byte("childLookup")
+	entriesBucket        = []byte("entries")
+	entryDevicesBucket   = []byte("entryDevices") // devices that have the current version
+	childLookupBucket    = []byte("childLookup")
+	deletedBucket        = []byte("deleted") // entries deleted, locally or by peers, until superseded
+	symlinkTargetsBucket = []byte("symlinkTargets")
 )
 
-func NewFileTreeCache(fldrCfg config.FolderConfiguration, db *bolt.DB, folder string) *FileTreeCache {
+func NewFileTreeCache(fldrCfg config.FolderConfiguration, db *bolt.DB, folder string, localDevice protocol.DeviceID) *FileTreeCache {
 	d := &FileTreeCache{
 		fldrCfg:         fldrCfg,
 		db:              db,
 		folder:          folder,
 		folderBucketKey: []byte(folder),
+		localDevice:     localDevice,
 	}
 
 	d.db.Update(func(tx *bolt.Tx) error {
@@ -54,19 +64,67 @@ func NewFileTreeCache(fldrCfg config.FolderConfiguration, db *bolt.DB, folder st
 			return fmt.Errorf("create bucket: %s", err)
 		}
 
+		_, err = b.CreateBucketIfNotExists([]byte(deletedBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		_, err = b.CreateBucketIfNotExists([]byte(symlinkTargetsBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
 		return nil
 	})
 
 	d.cleanupForUnsharedDevices()
+	d.countSize()
 
 	return d
 }
 
+// countSize totals the entries once, so later changes only adjust it.
+func (d *FileTreeCache) countSize() {
+	var bytes, files int64
+	for _, entry := range d.GetEntries() {
+		bytes += entry.Size
+		files += 1
+	}
+
+	d.countsMut.Lock()
+	d.totalBytes, d.totalFiles = bytes, files
+	d.countsMut.Unlock()
+}
+
+func (d *FileTreeCache) entriesChanged(bytes int64, files int64) {
+	d.countsMut.Lock()
+	d.totalBytes += bytes
+	d.totalFiles += files
+	d.generation += 1
+	d.countsMut.Unlock()
+}
+
+// Generation returns a number that changes whenever entries are added,
+// changed or removed, so views of the tree can tell when they are stale.
+func (d *FileTreeCache) Generation() uint64 {
+	d.countsMut.Lock()
+	defer d.countsMut.Unlock()
+	return d.generation
+}
+
+// GetSize returns the total size and number of entries.
+func (d *FileTreeCache) GetSize() (int64, int64) {
+	d.countsMut.Lock()
+	defer d.countsMut.Unlock()
+	return d.totalBytes, d.totalFiles
+}
+
 func (d *FileTreeCache) cleanupForUnsharedDevices() {
 	configuredDevices := make(map[string]bool)
 	for _, device := range d.fldrCfg.Devices {
 		configuredDevices[device.DeviceID.String()] = true
 	}
+	configuredDevices[d.localDevice.String()] = true
 
 	victims := make([]string, 0)
 
@@ -109,12 +167,26 @@ func (d *FileTreeCache) AddEntry(entry protocol.FileInfo, peer protocol.DeviceID
 	d.db.Update(func(tx *bolt.Tx) error {
 		eb := tx.Bucket(d.folderBucketKey).Bucket(entriesBucket)
 
+		/* replace size of previous version */
+		if v := eb.Get([]byte(entry.Name)); v != nil {
+			var previous protocol.FileInfo
+			rbuf := bytes.NewBuffer(v)
+			dec := gob.NewDecoder(rbuf)
+			dec.Decode(&previous)
+			defer d.entriesChanged(entry.Size-previous.Size, 0)
+		} else {
+			defer d.entriesChanged(entry.Size, 1)
+		}
+
 		/* save entry */
 		var buf bytes.Buffer
 		enc := gob.NewEncoder(&buf)
 		enc.Encode(entry)
 		eb.Put([]byte(entry.Name), buf.Bytes()) // TODO handle error?
 
+		/* supersede local deletion */
+		tx.Bucket(d.folderBucketKey).Bucket(deletedBucket).Delete([]byte(entry.Name))
+
 		/* add peer */
 		edb := tx.Bucket(d.folderBucketKey).Bucket(entryDevicesBucket)
 		v := edb.Get([]byte(entry.Name))
@@ -179,6 +251,50 @@ func (d *FileTreeCache) GetEntry(filepath string) (protocol.FileInfo, bool) {
 	return entry, found
 }
 
+func (d *FileTreeCache) GetEntries() []protocol.FileInfo {
+	entries := make([]protocol.FileInfo, 0)
+
+	d.db.View(func(tx *bolt.Tx) error {
+		eb := tx.Bucket(d.folderBucketKey).Bucket(entriesBucket)
+		eb.ForEach(func(key []byte, v []byte) error {
+			var entry protocol.FileInfo
+			buf := bytes.NewBuffer(v)
+			dec := gob.NewDecoder(buf)
+			dec.Decode(&entry)
+			entries = append(entries, entry)
+			return nil
+		})
+		return nil
+	})
+
+	return entries
+}
+
+// GetEntriesBelow returns the entries below a directory, or all entries for
+// the folder root, without decoding the rest of the folder.
+func (d *FileTreeCache) GetEntriesBelow(dir string) []protocol.FileInfo {
+	if dir == "" {
+		return d.GetEntries()
+	}
+
+	entries := make([]protocol.FileInfo, 0)
+	prefix := []byte(dir + "/")
+
+	d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(d.folderBucketKey).Bucket(entriesBucket).Cursor()
+		for key, v := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, v = c.Next() {
+			var entry protocol.FileInfo
+			buf := bytes.NewBuffer(v)
+			dec := gob.NewDecoder(buf)
+			dec.Decode(&entry)
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	return entries
+}
+
 func (d *FileTreeCache) GetEntryDevices(filepath string) ([]protocol.DeviceID, bool) {
 	var devices []protocol.DeviceID
 	found := false
@@ -210,6 +326,31 @@ func (d *FileTreeCache) GetEntryDevices(filepath string) ([]protocol.DeviceID, b
 	return devices, found
 }
 
+func (d *FileTreeCache) SetSymlinkTarget(filepath string, target string) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		stb := tx.Bucket(d.folderBucketKey).Bucket(symlinkTargetsBucket)
+		stb.Put([]byte(filepath), []byte(target))
+		return nil
+	})
+}
+
+func (d *FileTreeCache) GetSymlinkTarget(filepath string) (string, bool) {
+	var target string
+	found := false
+
+	d.db.View(func(tx *bolt.Tx) error {
+		stb := tx.Bucket(d.folderBucketKey).Bucket(symlinkTargetsBucket)
+		v := stb.Get([]byte(filepath))
+		if v != nil {
+			found = true
+			target = string(v)
+		}
+		return nil
+	})
+
+	return target, found
+}
+
 func (d *FileTreeCache) RemoveEntry(filepath string) {
 	entries := d.GetChildren(filepath)
 	for _, childPath := range entries {
@@ -219,12 +360,23 @@ func (d *FileTreeCache) RemoveEntry(filepath string) {
 	d.db.Update(func(tx *bolt.Tx) error {
 		// remove from entries
 		eb := tx.Bucket(d.folderBucketKey).Bucket(entriesBucket)
+		if v := eb.Get([]byte(filepath)); v != nil {
+			var entry protocol.FileInfo
+			rbuf := bytes.NewBuffer(v)
+			dec := gob.NewDecoder(rbuf)
+			dec.Decode(&entry)
+			defer d.entriesChanged(-entry.Size, -1)
+		}
 		eb.Delete([]byte(filepath)) // TODO handle error?
 
 		// remove devices
 		db := tx.Bucket(d.folderBucketKey).Bucket(entryDevicesBucket)
 		db.Delete([]byte(filepath))
 
+		// remove symlink target
+		stb := tx.Bucket(d.folderBucketKey).Bucket(symlinkTargetsBucket)
+		stb.Delete([]byte(filepath))
+
 		// remove from children lookup
 		dir := path.Dir(filepath)
 		clb := tx.Bucket(d.folderBucketKey).Bucket(childLookupBucket)
@@ -249,6 +401,66 @@ func (d *FileTreeCache) RemoveEntry(filepath string) {
 	})
 }
 
+func (d *FileTreeCache) AddDeletedEntry(entry protocol.FileInfo) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		delb := tx.Bucket(d.folderBucketKey).Bucket(deletedBucket)
+
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		enc.Encode(entry)
+		delb.Put([]byte(entry.Name), buf.Bytes())
+
+		return nil
+	})
+}
+
+func (d *FileTreeCache) GetDeletedEntry(filepath string) (protocol.FileInfo, bool) {
+	var entry protocol.FileInfo
+	found := false
+
+	d.db.View(func(tx *bolt.Tx) error {
+		delb := tx.Bucket(d.folderBucketKey).Bucket(deletedBucket)
+		v := delb.Get([]byte(filepath))
+		if v == nil {
+			return nil
+		}
+		found = true
+		buf := bytes.NewBuffer(v)
+		dec := gob.NewDecoder(buf)
+		dec.Decode(&entry)
+		return nil
+	})
+
+	return entry, found
+}
+
+func (d *FileTreeCache) RemoveDeletedEntry(filepath string) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		delb := tx.Bucket(d.folderBucketKey).Bucket(deletedBucket)
+		delb.Delete([]byte(filepath))
+		return nil
+	})
+}
+
+func (d *FileTreeCache) GetDeletedEntries() []protocol.FileInfo {
+	entries := make([]protocol.FileInfo, 0)
+
+	d.db.View(func(tx *bolt.Tx) error {
+		delb := tx.Bucket(d.folderBucketKey).Bucket(deletedBucket)
+		delb.ForEach(func(key []byte, v []byte) error {
+			var entry protocol.FileInfo
+			buf := bytes.NewBuffer(v)
+			dec := gob.NewDecoder(buf)
+			dec.Decode(&entry)
+			entries = append(entries, entry)
+			return nil
+		})
+		return nil
+	})
+
+	return entries
+}
+
 func (d *FileTreeCache) GetChildren(path string) []string {
 	var children []string
 	d.db.View(func(tx *bolt.Tx) error {
@@ -0,0 +1,167 @@
+package model
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/syncthing/syncthing/lib/connections"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+const (
+	indexBatchSize = 1000
+)
+
+// indexSequenceKey is where the folder bucket stores the last sequence number
+// sent to peers.
+var indexSequenceKey = []byte("indexSequence")
+
+// indexSender keeps one connected device up to date with what we hold
+// locally. It sends a full index for each shared folder when started, then
+// index updates for files marked as changed.
+type indexSender struct {
+	m       *Model
+	conn    connections.Connection
+	folders map[string]bool
+
+	pending map[string]map[string]bool // folder -> file names
+	mut     sync.Mutex                 // protects pending
+
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+func newIndexSender(m *Model, conn connections.Connection, folders []string) *indexSender {
+	s := &indexSender{
+		m:       m,
+		conn:    conn,
+		folders: make(map[string]bool),
+		pending: make(map[string]map[string]bool),
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+
+	for _, folder := range folders {
+		s.folders[folder] = true
+	}
+
+	return s
+}
+
+func (s *indexSender) Serve() {
+	for folder := range s.folders {
+		files := s.m.getLocalIndex(folder)
+		s.send(folder, files, false)
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.changed:
+		}
+
+		s.mut.Lock()
+		pending := s.pending
+		s.pending = make(map[string]map[string]bool)
+		s.mut.Unlock()
+
+		for folder, names := range pending {
+			files := s.m.getLocalFileInfos(folder, names)
+			if len(files) > 0 {
+				s.send(folder, files, true)
+			}
+		}
+	}
+}
+
+func (s *indexSender) Stop() {
+	close(s.stop)
+}
+
+func (s *indexSender) isSendingFolders(folders []string) bool {
+	if len(folders) != len(s.folders) {
+		return false
+	}
+	for _, folder := range folders {
+		if false == s.folders[folder] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *indexSender) markChanged(folder string, name string) {
+	if false == s.folders[folder] {
+		return
+	}
+
+	s.mut.Lock()
+	if _, ok := s.pending[folder]; !ok {
+		s.pending[folder] = make(map[string]bool)
+	}
+	s.pending[folder][name] = true
+	s.mut.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *indexSender) send(folder string, files []protocol.FileInfo, update bool) {
+	first := s.m.reserveSequences(folder, len(files))
+	for i := range files {
+		files[i].Sequence = first + int64(i)
+	}
+
+	for start := 0; start < len(files) || (start == 0 && false == update); start += indexBatchSize {
+		end := start + indexBatchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		batch := files[start:end]
+
+		if debug {
+			l.Debugln("model: sending", len(batch), "index entries for folder", folder, "to device", s.conn.ID().String()[:5])
+		}
+
+		var err error
+		if update || start > 0 {
+			err = s.conn.IndexUpdate(folder, batch)
+		} else {
+			err = s.conn.Index(folder, batch)
+		}
+		if err != nil {
+			if debug {
+				l.Debugln("model: sending index for folder", folder, "to device", s.conn.ID().String()[:5], "failed:", err)
+			}
+			return
+		}
+	}
+}
+
+// reserveSequences returns the first of n new sequence numbers for the
+// folder. The last one is stored, so sequences keep growing across
+// connections and restarts.
+func (m *Model) reserveSequences(folder string, n int) int64 {
+	var first int64 = 1
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(folder))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(indexSequenceKey); v != nil {
+			first = int64(binary.BigEndian.Uint64(v)) + 1
+		}
+
+		last := make([]byte, 8)
+		binary.BigEndian.PutUint64(last, uint64(first+int64(n)-1))
+		return b.Put(indexSequenceKey, last)
+	})
+	if err != nil {
+		l.Warnln("Cannot store index sequence of folder", folder, err)
+	}
+	return first
+}
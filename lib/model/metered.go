@@ -0,0 +1,165 @@
+package model
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/burkemw3/syncthingfuse/lib/config"
+	"github.com/syncthing/syncthing/lib/osutil"
+)
+
+// MeteredOverride forces the network to be treated as metered or not,
+// regardless of the configured metered networks.
+type MeteredOverride string
+
+const (
+	MeteredAuto MeteredOverride = "auto"
+	MeteredOn   MeteredOverride = "on"
+	MeteredOff  MeteredOverride = "off"
+)
+
+var errUnknownMeteredOverride = errors.New("metered must be auto, on or off")
+
+// MeteredStatus describes whether pins and read-ahead are paused to save
+// data on a metered network.
+type MeteredStatus struct {
+	Metered  bool            `json:"metered"`
+	Detected bool            `json:"detected"` // on a configured metered network
+	Override MeteredOverride `json:"override"`
+}
+
+// meteredNetworks are the networks configured as metered.
+type meteredNetworks struct {
+	interfaces []string
+	networks   []*net.IPNet
+}
+
+// newMeteredNetworks reads the metered networks from the options, ignoring
+// them if they don't parse.
+func newMeteredNetworks(options config.OptionsConfiguration) meteredNetworks {
+	interfaces, networks, err := options.GetMeteredNetworks()
+	if err != nil {
+		l.Warnln("Ignoring metered networks (", options.MeteredNetworks, "):", err)
+		return meteredNetworks{}
+	}
+	return meteredNetworks{interfaces: interfaces, networks: networks}
+}
+
+// setMeteredNetworksUnsafe changes the metered networks. Detecting them asks
+// the OS, so callers do that before taking lmut.
+// requires lmut before entry
+func (m *Model) setMeteredNetworksUnsafe(networks meteredNetworks, detected bool) {
+	m.meteredNetworks = networks
+	m.setMeteredDetectedUnsafe(detected)
+}
+
+// detect returns whether any configured metered network is in use.
+func (mn meteredNetworks) detect() bool {
+	for _, name := range mn.interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if addrs, err := iface.Addrs(); err == nil && len(addrs) > 0 {
+			return true
+		}
+	}
+
+	if len(mn.networks) == 0 {
+		return false
+	}
+	lans, err := osutil.GetLans()
+	if err != nil {
+		l.Debugln("Listing networks to detect metered ones:", err)
+		return false
+	}
+	for _, lan := range lans {
+		for _, network := range mn.networks {
+			if network.Contains(lan.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requires lmut before entry
+func (m *Model) setMeteredDetectedUnsafe(detected bool) {
+	before := m.isMeteredUnsafe()
+	m.meteredDetected = detected
+	m.meteredChangedUnsafe(before)
+}
+
+// requires lmut before entry
+func (m *Model) isMeteredUnsafe() bool {
+	switch m.meteredOverride {
+	case MeteredOn:
+		return true
+	case MeteredOff:
+		return false
+	}
+	return m.meteredDetected
+}
+
+// meteredChangedUnsafe resumes paused pulls when the network is no longer
+// metered.
+// requires lmut before entry
+func (m *Model) meteredChangedUnsafe(before bool) {
+	after := m.isMeteredUnsafe()
+	if before == after {
+		return
+	}
+
+	if after {
+		l.Infoln("Network is metered, pausing pins and read-ahead")
+	} else {
+		l.Infoln("Network is no longer metered, resuming pins and read-ahead")
+	}
+	m.lmut.Broadcast()
+}
+
+// SetMeteredOverride treats the network as metered or not, or goes back to
+// detecting it from the configured metered networks.
+func (m *Model) SetMeteredOverride(override MeteredOverride) error {
+	switch override {
+	case MeteredAuto, MeteredOn, MeteredOff:
+	default:
+		return errUnknownMeteredOverride
+	}
+
+	m.lmut.L.Lock()
+	defer m.lmut.L.Unlock()
+
+	before := m.isMeteredUnsafe()
+	m.meteredOverride = override
+	m.meteredChangedUnsafe(before)
+
+	return nil
+}
+
+func (m *Model) GetMeteredStatus() MeteredStatus {
+	m.lmut.L.Lock()
+	defer m.lmut.L.Unlock()
+
+	return MeteredStatus{
+		Metered:  m.isMeteredUnsafe(),
+		Detected: m.meteredDetected,
+		Override: m.meteredOverride,
+	}
+}
+
+// meteredRoutine notices joining or leaving metered networks.
+func (m *Model) meteredRoutine() {
+	for range time.Tick(30 * time.Second) {
+		m.lmut.L.Lock()
+		networks := m.meteredNetworks
+		m.lmut.L.Unlock()
+
+		detected := networks.detect()
+
+		m.lmut.L.Lock()
+		m.setMeteredDetectedUnsafe(detected)
+		m.lmut.L.Unlock()
+	}
+}
@@ -7,9 +7,9 @@ import (
 	b64 "encoding/base64"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
+	"reflect"
 	"sort"
 	"sync"
 	"time"
@@ -23,102 +23,466 @@ import (
 	"github.com/syncthing/syncthing/lib/connections"
 	"github.com/syncthing/syncthing/lib/protocol"
 	stsync "github.com/syncthing/syncthing/lib/sync"
+	"golang.org/x/net/context"
 )
 
 type Model struct {
-	cfg         *config.Wrapper
-	db          *bolt.DB
-	pinnedFiles map[string][]string // read-only after initialization
+	cfg      *config.Wrapper
+	db       *bolt.DB
+	myID     protocol.DeviceID
+	pinRules map[string]pinRules
 
+	cacheBudget   *fileblockcache.CacheBudget // nil unless a global cache size is configured
 	blockCaches   map[string]*fileblockcache.FileBlockCache
 	treeCaches    map[string]*filetreecache.FileTreeCache
 	folderDevices map[string][]protocol.DeviceID
+	ownership     map[string]folderOwnership
+	offlineOnly   map[string]bool
 	pulls         map[string]map[string]*blockPullStatus
-	fmut          stsync.RWMutex // protects file information. must not be acquired after pmut
+	staged        map[string]map[string]*stagedFile
+	pinRetries    map[string]map[string]*pinRetry // pinned files failed to pull, by folder and file
+	pinFills      map[string]map[string]int       // pin pulls outstanding, by folder and file
+
+	readAheadMaximum         int64 // bytes prefetched past sequential reads of a file
+	readAheadInFlight        int64 // bytes of prefetches in flight
+	readAheadInFlightMaximum int64
+	siblingPrefetch          map[string]siblingPrefetch
+
+	fmut stsync.RWMutex // protects file information, pins and read-ahead. must not be acquired after pmut
+
+	lastOpened    map[string]string        // last file opened for reading, per folder
+	siblingCaches map[string]*siblingCache // per folder
+	omut          sync.Mutex               // protects lastOpened and siblingCaches, which change under the fmut read lock
+
+	pullQueues         [pullPriorities]list.List // of *blockPullStatus
+	pullWorkers        int                       // running
+	pullWorkersMaximum int
+	pinPulls           int                  // running
+	pinSchedule        []config.DailyWindow // when pins are pulled, always if empty
+	meteredNetworks    meteredNetworks
+	meteredDetected    bool
+	meteredOverride    MeteredOverride
+	lmut               *sync.Cond // protects pull queues and workers. must not be acquired before fmut, nor after pmut
+
+	protoConn      map[protocol.DeviceID]connections.Connection
+	indexSenders   map[protocol.DeviceID]*indexSender
+	peers          *peerScheduler // has its own lock
+	limits         *pullLimits    // has its own lock
+	changeHandlers []ChangeHandler
+	pmut           stsync.RWMutex // protects protoConn, indexSenders and changeHandlers. must not be acquired before fmut
+}
 
-	pinnedList list.List
-	lmut       *sync.Cond // protects pull list. must not be acquired before fmut, nor after pmut
+// ChangeHandler is told which files of a folder peers changed, e.g. to drop
+// cached views of them. It is called without model locks held.
+type ChangeHandler func(folder string, files []string)
 
-	protoConn map[protocol.DeviceID]connections.Connection
-	pmut      stsync.RWMutex // protects protoConn. must not be acquired before fmut
+type folderOwnership struct {
+	uid uint32
+	gid uint32
 }
 
 func NewModel(cfg *config.Wrapper, db *bolt.DB) *Model {
 	var lmutex sync.Mutex
 	m := &Model{
-		cfg:         cfg,
-		db:          db,
-		pinnedFiles: make(map[string][]string),
+		cfg:      cfg,
+		db:       db,
+		pinRules: make(map[string]pinRules),
 
 		blockCaches:   make(map[string]*fileblockcache.FileBlockCache),
 		treeCaches:    make(map[string]*filetreecache.FileTreeCache),
 		folderDevices: make(map[string][]protocol.DeviceID),
+		ownership:     make(map[string]folderOwnership),
+		offlineOnly:   make(map[string]bool),
 		pulls:         make(map[string]map[string]*blockPullStatus),
+		staged:        make(map[string]map[string]*stagedFile),
+		pinRetries:    make(map[string]map[string]*pinRetry),
+		pinFills:      make(map[string]map[string]int),
 		fmut:          stsync.NewRWMutex(),
 
-		lmut: sync.NewCond(&lmutex),
+		siblingPrefetch: make(map[string]siblingPrefetch),
+		lastOpened:      make(map[string]string),
+		siblingCaches:   make(map[string]*siblingCache),
+
+		lmut:            sync.NewCond(&lmutex),
+		meteredOverride: MeteredAuto,
+
+		protoConn:    make(map[protocol.DeviceID]connections.Connection),
+		indexSenders: make(map[protocol.DeviceID]*indexSender),
+		peers:        newPeerScheduler(),
+		limits:       newPullLimits(),
+		pmut:         stsync.NewRWMutex(),
+	}
+
+	m.myID, _ = protocol.DeviceIDFromString(cfg.Raw().MyID)
+
+	m.setReadAheadLimitsUnsafe(cfg.Raw().Options)
 
-		protoConn: make(map[protocol.DeviceID]connections.Connection),
-		pmut:      stsync.NewRWMutex(),
+	cacheSize, err := cfg.Raw().Options.GetCacheSizeBytes()
+	if err != nil {
+		l.Warnln("Ignoring global cache size (", cfg.Raw().Options.CacheSize, "):", err)
+	} else if cacheSize > 0 {
+		m.cacheBudget = fileblockcache.NewCacheBudget(db, cacheSize)
 	}
 
 	for _, folderCfg := range m.cfg.Folders() {
-		folder := folderCfg.ID
+		m.addFolderUnsafe(folderCfg)
+	}
 
-		fbc, err := fileblockcache.NewFileBlockCache(m.cfg, db, folderCfg)
-		if err != nil {
-			l.Warnln("Skipping folder", folder, "because fileblockcache init failed:", err)
+	m.removeUnconfiguredFolders()
+
+	metered := newMeteredNetworks(cfg.Raw().Options)
+	meteredDetected := metered.detect()
+	m.lmut.L.Lock()
+	m.setPullWorkersUnsafe(cfg.Raw().Options)
+	m.setPinScheduleUnsafe(cfg.Raw().Options)
+	m.setMeteredNetworksUnsafe(metered, meteredDetected)
+	m.lmut.L.Unlock()
+	m.peers.setLimit(cfg.Raw().Options.PullsPerDevice)
+	m.limits.configure(cfg.Raw().Options)
+
+	go m.pinScheduleRoutine()
+	go m.meteredRoutine()
+
+	m.cfg.Subscribe(m)
+
+	return m
+}
+
+// requires fmut and lmut write locks before entry (or exclusive access during init)
+func (m *Model) addFolderUnsafe(folderCfg config.FolderConfiguration) {
+	folder := folderCfg.ID
+
+	fbc, err := fileblockcache.NewSharedFileBlockCache(m.cfg, m.db, folderCfg, m.cacheBudget)
+	if err != nil {
+		l.Warnln("Skipping folder", folder, "because fileblockcache init failed:", err)
+		return
+	}
+	m.blockCaches[folder] = fbc
+	m.treeCaches[folder] = filetreecache.NewFileTreeCache(folderCfg, m.db, folder, m.myID)
+
+	m.setFolderDevicesUnsafe(folderCfg)
+	m.setOwnershipUnsafe(folderCfg)
+	m.offlineOnly[folder] = folderCfg.OfflineOnly
+	m.setSiblingPrefetchUnsafe(folderCfg)
+
+	m.pulls[folder] = make(map[string]*blockPullStatus)
+
+	m.staged[folder] = make(map[string]*stagedFile)
+	m.resetWriteBackArea(folder)
+
+	m.setPinnedFilesUnsafe(folderCfg)
+	m.unpinUnnecessaryBlocks(folder)
+
+	m.pinRetries[folder] = make(map[string]*pinRetry)
+	m.pinFills[folder] = make(map[string]int)
+	m.resumePendingPinsUnsafe(folder, protocol.DeviceID{})
+}
+
+// requires fmut write lock before entry
+func (m *Model) removeFolderUnsafe(folder string) {
+	l.Infoln("Removing folder", folder)
+
+	for _, staged := range m.staged[folder] {
+		os.Remove(staged.diskPath)
+	}
+
+	if m.cacheBudget != nil {
+		m.cacheBudget.Remove(folder)
+	}
+
+	delete(m.blockCaches, folder)
+	delete(m.treeCaches, folder)
+	delete(m.folderDevices, folder)
+	delete(m.ownership, folder)
+	delete(m.offlineOnly, folder)
+	delete(m.siblingPrefetch, folder)
+	m.omut.Lock()
+	delete(m.lastOpened, folder)
+	delete(m.siblingCaches, folder)
+	m.omut.Unlock()
+	delete(m.pulls, folder)
+	for file := range m.pinRetries[folder] {
+		m.cancelPinRetryUnsafe(folder, file)
+	}
+	delete(m.pinRetries, folder)
+	delete(m.pinFills, folder)
+	delete(m.staged, folder)
+	delete(m.pinRules, folder)
+}
+
+// requires fmut write lock before entry (or exclusive access during init)
+func (m *Model) setFolderDevicesUnsafe(folderCfg config.FolderConfiguration) {
+	m.folderDevices[folderCfg.ID] = make([]protocol.DeviceID, len(folderCfg.Devices))
+	for i, device := range folderCfg.Devices {
+		m.folderDevices[folderCfg.ID][i] = device.DeviceID
+	}
+}
+
+// requires fmut write lock before entry (or exclusive access during init)
+func (m *Model) setOwnershipUnsafe(folderCfg config.FolderConfiguration) {
+	uid, gid, err := folderCfg.GetOwnership()
+	if err != nil {
+		l.Warnln("Cannot resolve owner (", folderCfg.Owner, ") or group (", folderCfg.Group, ") for folder", folderCfg.ID, err)
+		uid, gid = uint32(os.Getuid()), uint32(os.Getgid())
+	}
+	m.ownership[folderCfg.ID] = folderOwnership{uid: uid, gid: gid}
+}
+
+// requires fmut write lock before entry (or exclusive access during init)
+func (m *Model) setPinnedFilesUnsafe(folderCfg config.FolderConfiguration) {
+	m.pinRules[folderCfg.ID] = newPinRules(folderCfg.PinnedFiles, folderCfg.PinnedPatterns)
+}
+
+// CommitConfiguration applies configuration changes without a restart. It
+// returns false if some change requires a restart anyway.
+func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
+	fromFolders := make(map[string]config.FolderConfiguration)
+	for _, folderCfg := range from.Folders {
+		fromFolders[folderCfg.ID] = folderCfg
+	}
+	toFolders := make(map[string]config.FolderConfiguration)
+	for _, folderCfg := range to.Folders {
+		toFolders[folderCfg.ID] = folderCfg
+	}
+
+	fromCacheSize, _ := from.Options.GetCacheSizeBytes()
+	toCacheSize, _ := to.Options.GetCacheSizeBytes()
+	budgetResized := m.cacheBudget != nil && fromCacheSize != toCacheSize && toCacheSize > 0
+
+	metered := newMeteredNetworks(to.Options)
+	meteredDetected := metered.detect()
+
+	m.fmut.Lock()
+	m.lmut.L.Lock()
+
+	for folder := range m.treeCaches {
+		if _, ok := toFolders[folder]; !ok {
+			m.removeFolderUnsafe(folder)
+		}
+	}
+
+	if budgetResized {
+		m.cacheBudget.Resize(toCacheSize)
+	}
+
+	m.setReadAheadLimitsUnsafe(to.Options)
+	m.setPullWorkersUnsafe(to.Options)
+	m.setPinScheduleUnsafe(to.Options)
+	m.setMeteredNetworksUnsafe(metered, meteredDetected)
+	m.peers.setLimit(to.Options.PullsPerDevice)
+	m.limits.configure(to.Options)
+
+	for folder, toCfg := range toFolders {
+		fromCfg, existed := fromFolders[folder]
+		if _, ok := m.treeCaches[folder]; !ok || !existed {
+			l.Infoln("Adding folder", folder)
+			m.addFolderUnsafe(toCfg)
 			continue
 		}
-		m.blockCaches[folder] = fbc
-		m.treeCaches[folder] = filetreecache.NewFileTreeCache(folderCfg, db, folder)
 
-		m.folderDevices[folder] = make([]protocol.DeviceID, len(folderCfg.Devices))
-		for i, device := range folderCfg.Devices {
-			m.folderDevices[folder][i] = device.DeviceID
+		if false == reflect.DeepEqual(fromCfg.Devices, toCfg.Devices) {
+			m.setFolderDevicesUnsafe(toCfg)
+			// rebuilding the tree cache forgets files only unshared devices had
+			m.treeCaches[folder] = filetreecache.NewFileTreeCache(toCfg, m.db, folder, m.myID)
 		}
 
-		m.pulls[folder] = make(map[string]*blockPullStatus)
+		if budgetResized || fromCfg.CacheSize != toCfg.CacheSize ||
+			fromCfg.CacheMinimum != toCfg.CacheMinimum || fromCfg.CacheMaximum != toCfg.CacheMaximum ||
+			fromCfg.CachePolicy != toCfg.CachePolicy {
+			if err := m.blockCaches[folder].Configure(toCfg); err != nil {
+				l.Warnln("Cannot apply cache configuration of folder", folder, err)
+			}
+		}
+
+		if fromCfg.Owner != toCfg.Owner || fromCfg.Group != toCfg.Group {
+			m.setOwnershipUnsafe(toCfg)
+		}
 
-		m.pinnedFiles[folder] = make([]string, len(folderCfg.PinnedFiles))
-		copy(m.pinnedFiles[folder], folderCfg.PinnedFiles)
-		sort.Strings(m.pinnedFiles[folder])
-		m.unpinUnnecessaryBlocks(folder)
+		m.offlineOnly[folder] = toCfg.OfflineOnly
+		m.setSiblingPrefetchUnsafe(toCfg)
+
+		if false == reflect.DeepEqual(fromCfg.PinnedFiles, toCfg.PinnedFiles) ||
+			false == reflect.DeepEqual(fromCfg.PinnedPatterns, toCfg.PinnedPatterns) {
+			m.updatePinnedFilesUnsafe(toCfg)
+		}
 	}
 
 	m.removeUnconfiguredFolders()
 
-	for i := 0; i < 4; i++ {
-		go m.backgroundPinnerRoutine()
+	m.lmut.Broadcast()
+	m.lmut.L.Unlock()
+
+	m.pmut.Lock()
+	m.updateConnectionsUnsafe(to)
+	m.pmut.Unlock()
+
+	m.fmut.Unlock()
+
+	// the Syncthing services and mounts are only configured on startup, and
+	// the global cache can only be resized, not turned on or off
+	fromOptions, toOptions := from.Options, to.Options
+	fromOptions.CacheSize, toOptions.CacheSize = "", ""
+	fromOptions.ReadTimeoutS, toOptions.ReadTimeoutS = 0, 0
+	fromOptions.ReadAheadMaximum, toOptions.ReadAheadMaximum = "", ""
+	fromOptions.ReadAheadInFlight, toOptions.ReadAheadInFlight = "", ""
+	fromOptions.PullWorkers, toOptions.PullWorkers = 0, 0
+	fromOptions.PullsPerDevice, toOptions.PullsPerDevice = 0, 0
+	fromOptions.MaxRecvKbps, toOptions.MaxRecvKbps = 0, 0
+	fromOptions.MaxPinRecvKbps, toOptions.MaxPinRecvKbps = 0, 0
+	fromOptions.DeviceRateLimits, toOptions.DeviceRateLimits = nil, nil
+	fromOptions.PinSchedule, toOptions.PinSchedule = "", ""
+	fromOptions.MeteredNetworks, toOptions.MeteredNetworks = nil, nil
+	return from.MountPoint == to.MountPoint &&
+		false == mountsChanged(fromFolders, toFolders) &&
+		reflect.DeepEqual(fromOptions, toOptions) &&
+		(fromCacheSize == 0) == (toCacheSize == 0) &&
+		from.GUI == to.GUI
+}
+
+// mountsChanged returns whether folders are mounted differently, which
+// takes a restart.
+func mountsChanged(from, to map[string]config.FolderConfiguration) bool {
+	for folder, toCfg := range to {
+		fromCfg, existed := from[folder]
+		if false == existed {
+			if toCfg.MountPoint != "" || toCfg.SkipCombinedMount {
+				return true
+			}
+			continue
+		}
+		if fromCfg.MountPoint != toCfg.MountPoint || fromCfg.SkipCombinedMount != toCfg.SkipCombinedMount {
+			return true
+		}
+	}
+	for folder, fromCfg := range from {
+		if _, ok := to[folder]; !ok && fromCfg.MountPoint != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// requires fmut and lmut write locks before entry
+func (m *Model) updatePinnedFilesUnsafe(folderCfg config.FolderConfiguration) {
+	folder := folderCfg.ID
+	wasPinned := m.getPinnedEntries(folder)
+
+	m.setPinnedFilesUnsafe(folderCfg)
+	m.unpinUnnecessaryBlocks(folder)
+
+	changed := make([]string, 0)
+	for _, entry := range wasPinned {
+		if false == m.isFilePinned(folder, entry.Name) {
+			changed = append(changed, entry.Name)
+		}
+	}
+	for _, entry := range m.getPinnedEntries(folder) {
+		m.queuePinnedFileUnsafe(folder, entry)
 	}
 
-	return m
+	m.clearPinPendingUnsafe(folder, changed)
+	for _, file := range changed {
+		m.cancelPinRetryUnsafe(folder, file)
+		delete(m.pinRetries[folder], file)
+	}
+
+	m.pmut.RLock()
+	for _, file := range changed {
+		m.markIndexChanged(folder, file)
+	}
+	m.pmut.RUnlock()
+}
+
+// queuePinnedFileUnsafe queues pulling the blocks of a pinned file not yet
+// pinned, and records the file as pending until they are. Blocks already
+// queued or in flight aren't queued again. It returns false if all blocks
+// are pinned.
+// requires fmut and lmut write locks before entry
+func (m *Model) queuePinnedFileUnsafe(folder string, entry protocol.FileInfo) bool {
+	fbc := m.blockCaches[folder]
+	queued := false
+	for i, block := range entry.Blocks {
+		if false == fbc.HasPinnedBlock(block.Hash) {
+			blockStart := int64(i * protocol.BlockSize)
+			m.getOrCreatePullStatus("Pin fetch", folder, entry.Name, block, blockStart, pullPriorityPin)
+			queued = true
+		}
+	}
+
+	if queued {
+		m.markPinPendingUnsafe(folder, entry.Name)
+	}
+	return queued
+}
+
+// updateConnectionsUnsafe drops connections to devices no longer configured,
+// and resends cluster configs to devices whose shared folders changed.
+// requires fmut read (or better) and pmut write locks before entry
+func (m *Model) updateConnectionsUnsafe(to config.Configuration) {
+	configured := make(map[protocol.DeviceID]bool)
+	for _, device := range to.Devices {
+		configured[device.DeviceID] = true
+	}
+
+	for deviceID, conn := range m.protoConn {
+		if false == configured[deviceID] {
+			l.Infoln("Closing connection to removed device", deviceID)
+			closeRawConn(conn)
+			continue
+		}
+
+		cm, sharedFolders := m.clusterConfigUnsafe(deviceID)
+
+		sender, ok := m.indexSenders[deviceID]
+		if ok && sender.isSendingFolders(sharedFolders) {
+			continue
+		}
+
+		if debug {
+			l.Debugln("model: shared folders changed for device", deviceID.String()[:5], "resending cluster config")
+		}
+
+		conn.ClusterConfig(cm)
+
+		if ok {
+			sender.Stop()
+		}
+		sender = newIndexSender(m, conn, sharedFolders)
+		m.indexSenders[deviceID] = sender
+		go sender.Serve()
+	}
 }
 
 var (
-	errDeviceUnknown = errors.New("unknown device")
+	ErrPinnedByRule = errors.New("pinned by another rule")
+	ErrReadTimeout  = errors.New("timed out waiting for peers")
+
+	errDeviceUnknown      = errors.New("unknown device")
+	errDeviceNotConnected = errors.New("device not connected")
+	errPullAbandoned      = errors.New("pull abandoned")
 )
 
-func (m *Model) unpinUnnecessaryBlocks(folder string) {
-	candidates := list.New()
-	first, _ := m.treeCaches[folder].GetEntry("")
-	candidates.PushBack(first)
+const (
+	maxRequestAttempts = 3
 
-	for candidates.Len() > 0 {
-		el := candidates.Front()
-		candidates.Remove(el)
-		entry, _ := el.Value.(protocol.FileInfo)
+	// connections as direct as each other are compared by asking both for
+	// this file, and a new one has to be clearly faster to replace the old
+	latencyProbeFile      = ".syncthingfuse-latency-probe"
+	latencyProbeTimeout   = 5 * time.Second
+	preferredLatencyRatio = 0.8
+)
 
-		if false == m.isFilePinned(folder, entry.Name) {
-			for _, block := range entry.Blocks {
-				m.blockCaches[folder].UnpinBlock(block.Hash)
-			}
+func (m *Model) unpinUnnecessaryBlocks(folder string) {
+	fbc := m.blockCaches[folder]
+
+	for _, entry := range m.treeCaches[folder].GetEntries() {
+		if m.isFilePinned(folder, entry.Name) || m.isLocallyAuthored(folder, entry.Name) {
+			continue
 		}
 
-		if entry.IsDirectory() {
-			children := m.treeCaches[folder].GetChildren(entry.Name)
-			for _, child := range children {
-				candidates.PushBack(child)
+		for _, block := range entry.Blocks {
+			if fbc.HasPinnedBlock(block.Hash) {
+				fbc.UnpinBlock(block.Hash)
 			}
 		}
 	}
@@ -186,16 +550,54 @@ func (m *Model) OnHello(remoteID protocol.DeviceID, addr net.Addr, hello protoco
 func (m *Model) AddConnection(conn connections.Connection, hello protocol.HelloResult) {
 	deviceID := conn.ID()
 
+	m.fmut.RLock()
+	m.pmut.RLock()
+	oldConn, connected := m.protoConn[deviceID]
+	cm, sharedFolders := m.clusterConfigUnsafe(deviceID)
+	m.pmut.RUnlock()
+	m.fmut.RUnlock()
+
+	// connections as direct as each other are told apart by latency. The new
+	// one has to introduce itself before it can be asked anything.
+	var newLatency, oldLatency time.Duration
+	started := false
+	if connected && conn.Priority == oldConn.Priority && len(sharedFolders) > 0 {
+		conn.Start()
+		conn.ClusterConfig(cm)
+		started = true
+		newLatency = measureLatency(conn, sharedFolders[0])
+		oldLatency = measureLatency(oldConn, sharedFolders[0])
+	}
+
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	m.pmut.Lock()
 	defer m.pmut.Unlock()
 
-	if _, ok := m.protoConn[deviceID]; ok {
-		// TODO syncthing replaces connections, possibly for relays, so we should to that
-		panic("add existing device")
+	if currentConn, ok := m.protoConn[deviceID]; ok {
+		if false == connected || currentConn.Connection != oldConn.Connection {
+			// replaced while measuring, so neither latency says anything
+			newLatency, oldLatency = 0, 0
+		}
+		oldConn = currentConn
+		if false == isPreferredConnection(conn, oldConn, newLatency, oldLatency) {
+			l.Infoln("Keeping connection", oldConn, "over", conn, "for device", deviceID)
+			closeRawConn(conn)
+			return
+		}
+
+		l.Infoln("Replacing connection", oldConn, "with", conn, "for device", deviceID)
+
+		// Closed will be called for the old connection later, and ignored,
+		// since it's no longer the current one.
+		if sender, ok := m.indexSenders[deviceID]; ok {
+			sender.Stop()
+			delete(m.indexSenders, deviceID)
+		}
+		closeRawConn(oldConn)
 	}
 	m.protoConn[deviceID] = conn
+	m.peers.reset(deviceID)
 
 	device, ok := m.cfg.Devices()[deviceID]
 	if ok && device.Name == "" {
@@ -204,12 +606,31 @@ func (m *Model) AddConnection(conn connections.Connection, hello protocol.HelloR
 		m.cfg.Save()
 	}
 
-	conn.Start()
+	if false == started {
+		conn.Start()
+	}
 
 	// TODO how do we know the device is in our config and we should send cluster config?
 
 	/* build and send cluster config */
+	cm, sharedFolders = m.clusterConfigUnsafe(deviceID)
+	conn.ClusterConfig(cm)
+
+	/* start sending our index */
+	sender := newIndexSender(m, conn, sharedFolders)
+	m.indexSenders[deviceID] = sender
+	go sender.Serve()
+
+	// pins that failed while the device was away needn't wait for a retry
+	go m.retryPinsFrom(deviceID)
+}
+
+// clusterConfigUnsafe builds the cluster config for a device, and lists the
+// folders shared with it.
+// requires fmut read (or better) lock before entry
+func (m *Model) clusterConfigUnsafe(deviceID protocol.DeviceID) (protocol.ClusterConfig, []string) {
 	cm := protocol.ClusterConfig{}
+	sharedFolders := make([]string, 0)
 
 	for folderName, devices := range m.folderDevices {
 		found := false
@@ -239,9 +660,60 @@ func (m *Model) AddConnection(conn connections.Connection, hello protocol.HelloR
 		}
 
 		cm.Folders = append(cm.Folders, cr)
+		sharedFolders = append(sharedFolders, folderName)
 	}
 
-	conn.ClusterConfig(cm)
+	return cm, sharedFolders
+}
+
+// isPreferredConnection decides whether a new connection to a device should
+// replace an existing one. Lower priorities are better, e.g. direct over
+// relay. Between equal priorities, a clearly faster round trip wins, as does
+// one that answers over one that doesn't. A latency of zero means it wasn't
+// measured. Otherwise the existing connection is kept.
+func isPreferredConnection(newConn connections.Connection, oldConn connections.Connection, newLatency time.Duration, oldLatency time.Duration) bool {
+	if newConn.Priority != oldConn.Priority {
+		return newConn.Priority < oldConn.Priority
+	}
+	if newLatency == 0 {
+		return false
+	}
+	if oldLatency == 0 {
+		return true
+	}
+	return float64(newLatency) < preferredLatencyRatio*float64(oldLatency)
+}
+
+// measureLatency times a round trip over a connection, by asking for a file
+// that doesn't exist. Any answer, even an error, counts. Returns zero if the
+// connection doesn't answer in time.
+func measureLatency(conn connections.Connection, folder string) time.Duration {
+	answered := make(chan struct{}, 1)
+	start := time.Now()
+	go func() {
+		conn.Request(folder, latencyProbeFile, 0, 1, nil, false)
+		answered <- struct{}{}
+	}()
+
+	timer := time.NewTimer(latencyProbeTimeout)
+	defer timer.Stop()
+	select {
+	case <-answered:
+		latency := time.Since(start)
+		if latency == 0 {
+			latency = time.Nanosecond
+		}
+		return latency
+	case <-timer.C:
+		return 0
+	}
+}
+
+// closeRawConn closes the underlying network connection, which makes the
+// protocol layer report the connection as closed.
+func closeRawConn(conn connections.Connection) {
+	conn.SetDeadline(time.Now().Add(250 * time.Millisecond))
+	conn.Conn.Close()
 }
 
 func (m *Model) ConnectedTo(deviceID protocol.DeviceID) bool {
@@ -292,23 +764,61 @@ func (m *Model) GetEntry(folder string, path string) (protocol.FileInfo, bool) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 
-	return m.treeCaches[folder].GetEntry(path)
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return protocol.FileInfo{}, false
+	}
+
+	entry, found := treeCache.GetEntry(path)
+
+	// files being written report their staged size
+	if staged, ok := m.staged[folder][path]; ok && found {
+		if info, err := os.Stat(staged.diskPath); err == nil {
+			entry.Size = info.Size()
+		}
+	}
+
+	return entry, found
+}
+
+// GetFileData reads from a file, pulling missing blocks from peers. The read
+// gives up when ctx is done, or after the configured read timeout.
+func (m *Model) GetFileData(ctx context.Context, folder string, filepath string, readStart int64, readSize int) ([]byte, error) {
+	return m.ReadFileData(ctx, nil, folder, filepath, readStart, readSize)
 }
 
-func (m *Model) GetFileData(folder string, filepath string, readStart int64, readSize int) ([]byte, error) {
+// ReadFileData is GetFileData for an open file, prefetching ahead as the
+// access pattern tracked by ra allows. Without ra, one block is prefetched.
+func (m *Model) ReadFileData(ctx context.Context, ra *ReadAhead, folder string, filepath string, readStart int64, readSize int) ([]byte, error) {
 	start := time.Now()
 
+	if timeout := m.cfg.Raw().Options.GetReadTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	m.fmut.Lock()
 	if debug {
 		flet := time.Now()
 		dur := flet.Sub(start).Seconds()
 		l.Debugln("Read for", folder, filepath, readStart, readSize, "Lock took", dur)
 	}
-	m.pmut.RLock()
+	if staged, ok := m.staged[folder][filepath]; ok {
+		defer m.fmut.Unlock()
+		return m.readStagedFileData(staged, readStart, readSize)
+	}
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		m.fmut.Unlock()
+		return []byte(""), protocol.ErrNoSuchFile
+	}
 
-	entry, found := m.treeCaches[folder].GetEntry(filepath)
+	entry, found := treeCache.GetEntry(filepath)
 	if false == found {
 		l.Warnln("File not found", folder, filepath)
+		m.fmut.Unlock()
 		return []byte(""), protocol.ErrNoSuchFile
 	}
 
@@ -317,10 +827,15 @@ func (m *Model) GetFileData(folder string, filepath string, readStart int64, rea
 	pendingBlocks := make([]pendingBlockRead, 0)
 	fbc := m.blockCaches[folder]
 
-	m.pmut.RLock()
-	defer m.pmut.RUnlock()
+	readAheadEnd := readEnd + readAheadMinimum
+	if ra != nil {
+		readAheadEnd = readEnd + ra.update(readStart, readSize, m.readAheadMaximum)
+	}
+	prefetching := true
+
+	m.lmut.L.Lock()
 
-	// create workers for pulling
+	// queue pulls
 	for i, block := range entry.Blocks {
 		blockStart := int64(i * protocol.BlockSize)
 		blockEnd := blockStart + int64(block.Size)
@@ -338,35 +853,27 @@ func (m *Model) GetFileData(folder string, filepath string, readStart int64, rea
 						blockStart:      blockStart,
 						readEnd:         readEnd,
 						blockEnd:        blockEnd,
-						blockPullStatus: m.getOrCreatePullStatus("Fetch", folder, filepath, block, blockStart, assigned),
+						blockPullStatus: m.getOrCreatePullStatus("Fetch", folder, filepath, block, blockStart, pullPriorityRead),
 					}
+					pendingBlock.blockPullStatus.readers += 1
 					pendingBlocks = append(pendingBlocks, pendingBlock)
 				}
-			} else if blockStart < readEnd+protocol.BlockSize {
-				if false == fbc.HasCachedBlockData(block.Hash) && false == fbc.HasPinnedBlock(block.Hash) {
-					// prefetch this block
-					m.getOrCreatePullStatus("Prefetch", folder, filepath, block, blockStart, assigned)
-				}
+			} else if prefetching && blockStart < readAheadEnd {
+				prefetching = m.prefetchBlockUnsafe(folder, filepath, block, blockStart)
 			}
 		}
 	}
 
+	m.lmut.L.Unlock()
 	m.fmut.Unlock()
-	m.pmut.RUnlock()
 
 	// wait for needed blocks
-	for _, pendingBlock := range pendingBlocks {
-		pendingBlock.blockPullStatus.cv.L.Lock()
-		for done != pendingBlock.blockPullStatus.state {
-			pendingBlock.blockPullStatus.cv.Wait()
-		}
-		pendingBlock.blockPullStatus.cv.L.Unlock()
-		pendingBlock.blockPullStatus.mutex.RLock()
-		if pendingBlock.blockPullStatus.error != nil {
-			return []byte(""), pendingBlock.blockPullStatus.error
+	err := m.waitForPendingBlocks(ctx, pendingBlocks, data)
+	if err != nil {
+		if debug {
+			l.Debugln("Read for", folder, filepath, readStart, readSize, "failed:", err)
 		}
-		copyBlockData(pendingBlock.blockPullStatus.data, pendingBlock.readStart, pendingBlock.blockStart, pendingBlock.readEnd, pendingBlock.blockEnd, data)
-		pendingBlock.blockPullStatus.mutex.RUnlock()
+		return []byte(""), err
 	}
 
 	if debug {
@@ -378,6 +885,114 @@ func (m *Model) GetFileData(folder string, filepath string, readStart int64, rea
 	return data, nil
 }
 
+// waitForPendingBlocks copies pulled blocks into data as they arrive. If ctx
+// is done first, pulls no other read waits for are abandoned.
+func (m *Model) waitForPendingBlocks(ctx context.Context, pendingBlocks []pendingBlockRead, data []byte) error {
+	var err error
+
+	for _, pendingBlock := range pendingBlocks {
+		status := pendingBlock.blockPullStatus
+
+		select {
+		case <-status.finished:
+		case <-ctx.Done():
+			err = readError(ctx.Err())
+		}
+		if err != nil {
+			break
+		}
+
+		status.mutex.RLock()
+		err = status.error
+		if err == nil {
+			copyBlockData(status.data, pendingBlock.readStart, pendingBlock.blockStart, pendingBlock.readEnd, pendingBlock.blockEnd, data)
+		}
+		status.mutex.RUnlock()
+		if err != nil {
+			break
+		}
+	}
+
+	m.fmut.Lock()
+	for _, pendingBlock := range pendingBlocks {
+		status := pendingBlock.blockPullStatus
+		status.readers -= 1
+		if err != nil && status.readers == 0 && status.abandonable {
+			m.abandonPullUnsafe(status)
+		}
+	}
+	m.fmut.Unlock()
+
+	return err
+}
+
+func readError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrReadTimeout
+	}
+	return err
+}
+
+// abandonPullUnsafe stops a pull nobody waits for anymore. Later reads of
+// the block start a new pull.
+// requires fmut write lock before entry
+func (m *Model) abandonPullUnsafe(status *blockPullStatus) {
+	select {
+	case <-status.finished:
+		return
+	case <-status.abandon:
+		return
+	default:
+	}
+
+	if debug {
+		l.Debugln("Abandoning pull of block at offset", status.offset, "for", status.folder, status.file)
+	}
+
+	close(status.abandon)
+
+	hash := b64.URLEncoding.EncodeToString(status.block.Hash)
+	if m.pulls[status.folder][hash] == status {
+		delete(m.pulls[status.folder], hash)
+	}
+}
+
+// GetSymlinkTarget returns where a symlink points. Peers send the target as
+// the symlink's file data, so it is fetched like any file, then remembered.
+func (m *Model) GetSymlinkTarget(ctx context.Context, folder string, filepath string) (string, error) {
+	m.fmut.RLock()
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		m.fmut.RUnlock()
+		return "", protocol.ErrNoSuchFile
+	}
+	entry, found := treeCache.GetEntry(filepath)
+	target, known := treeCache.GetSymlinkTarget(filepath)
+	m.fmut.RUnlock()
+
+	if false == found || false == entry.IsSymlink() {
+		return "", protocol.ErrNoSuchFile
+	}
+	if known {
+		return target, nil
+	}
+
+	data, err := m.GetFileData(ctx, folder, filepath, 0, int(entry.Size))
+	if err != nil {
+		return "", err
+	}
+	target = string(data)
+
+	m.fmut.Lock()
+	current, found := treeCache.GetEntry(filepath)
+	if found && current.Version.Equal(entry.Version) {
+		treeCache.SetSymlinkTarget(filepath, target)
+	}
+	m.fmut.Unlock()
+
+	return target, nil
+}
+
 func copyBlockData(blockData []byte, readStart int64, blockStart int64, readEnd int64, blockEnd int64, data []byte) {
 	for j := mathutil.MaxInt64(readStart, blockStart); j < readEnd && j < blockEnd; j++ {
 		outputItr := j - readStart
@@ -404,87 +1019,87 @@ const (
 )
 
 type blockPullStatus struct {
-	comment string
-	folder  string
-	file    string
-	block   protocol.BlockInfo
-	offset  int64
-	state   blockPullState
-	data    []byte
-	error   error
-	mutex   *sync.RWMutex
-	cv      *sync.Cond // protects this data structure. cannot be acquired before any global locks (e.g. fmut)
-}
-
-// requires fmut write lock and pmut read lock (or better) before entry
-func (m *Model) getOrCreatePullStatus(comment string, folder string, file string, block protocol.BlockInfo, offset int64, state blockPullState) *blockPullStatus {
+	comment     string
+	folder      string
+	file        string
+	block       protocol.BlockInfo
+	offset      int64
+	state       blockPullState
+	data        []byte
+	error       error
+	mutex       *sync.RWMutex
+	cv          *sync.Cond    // protects this data structure. cannot be acquired before any global locks (e.g. fmut)
+	finished    chan struct{} // closed when state becomes done
+	abandon     chan struct{} // closed, under fmut, when no read waits for the pull anymore
+	abandonable bool          // pulled for reads, rather than pins. requires fmut
+	pin         bool          // pin the block once pulled. requires fmut
+	pinFile     string        // pinned file the block was first pinned for. requires fmut
+	readers     int           // reads waiting for the pull. requires fmut
+	priority    pullPriority  // highest asked for. requires fmut and lmut
+	element     *list.Element // in its pull queue, until a worker takes it. requires lmut
+	raised      chan struct{} // closed, under fmut and lmut, when reads ask for a pin
+
+	readAheadBytes int64 // counted against the read-ahead budget. requires fmut
+}
+
+// getOrCreatePullStatus returns the pull of a block, queueing a new one. A
+// pull still queued at a lower priority moves to the queue of the higher
+// one, so e.g. a read jumps ahead of pinning. Pins mark the pull to pin the
+// block once pulled.
+// requires fmut and lmut write locks before entry
+func (m *Model) getOrCreatePullStatus(comment string, folder string, file string, block protocol.BlockInfo, offset int64, priority pullPriority) *blockPullStatus {
 	hash := b64.URLEncoding.EncodeToString(block.Hash)
 
 	pullStatus, ok := m.pulls[folder][hash]
 	if ok {
+		// already queued or in flight, so only pin it once pulled
+		if priority == pullPriorityPin && false == pullStatus.pin {
+			pullStatus.pin = true
+			pullStatus.abandonable = false
+			m.addPinFillUnsafe(pullStatus, file)
+		}
+		if priority < pullStatus.priority {
+			m.reprioritizePullUnsafe(pullStatus, priority)
+		}
 		return pullStatus
 	}
 
 	var mutex sync.RWMutex
 	pullStatus = &blockPullStatus{
-		comment: comment,
-		folder:  folder,
-		file:    file,
-		block:   block,
-		offset:  offset,
-		state:   state,
-		mutex:   &mutex,
-		cv:      sync.NewCond(&mutex),
+		comment:     comment,
+		folder:      folder,
+		file:        file,
+		block:       block,
+		offset:      offset,
+		state:       queued,
+		mutex:       &mutex,
+		cv:          sync.NewCond(&mutex),
+		finished:    make(chan struct{}),
+		abandon:     make(chan struct{}),
+		raised:      make(chan struct{}),
+		abandonable: priority != pullPriorityPin,
+		pin:         priority == pullPriorityPin,
+		priority:    priority,
 	}
 
 	m.pulls[folder][hash] = pullStatus
-
-	if assigned == state {
-		go m.pullBlock(pullStatus, true)
+	if pullStatus.pin {
+		m.addPinFillUnsafe(pullStatus, file)
 	}
+	m.enqueuePullUnsafe(pullStatus, priority)
 
 	return pullStatus
 }
 
-func (m *Model) backgroundPinnerRoutine() {
-	var status *blockPullStatus
+// requires fmut read lock or better before entry
+func (m *Model) isBlockStillNeeded(status *blockPullStatus) bool {
+	treeCache, ok := m.treeCaches[status.folder]
+	if !ok {
+		// folder removed from configuration
+		return false
+	}
 
-	for {
-		m.lmut.L.Lock()
-		for 0 == m.pinnedList.Len() {
-			m.lmut.Wait()
-		}
-		el := m.pinnedList.Front()
-		m.pinnedList.Remove(el)
-		status, _ = el.Value.(*blockPullStatus)
-		m.lmut.L.Unlock()
-
-		m.fmut.Lock()
-		status.mutex.RLock()
-		if m.isBlockStillNeeded(status) {
-			if m.blockCaches[status.folder].HasCachedBlockData(status.block.Hash) {
-				m.blockCaches[status.folder].PinExistingBlock(status.block)
-			} else {
-				m.fmut.Unlock()
-				status.mutex.RUnlock()
-
-				m.pullBlock(status, false)
-
-				m.fmut.Lock()
-				status.mutex.RLock()
-				if m.isBlockStillNeeded(status) {
-					m.blockCaches[status.folder].PinNewBlock(status.block, status.data)
-				}
-			}
-		}
-		m.fmut.Unlock()
-		status.mutex.RUnlock()
-	}
-}
-
-// requires read locks or better on fmut and status.cv.L
-func (m *Model) isBlockStillNeeded(status *blockPullStatus) bool {
-	entry, found := m.treeCaches[status.folder].GetEntry(status.file)
+	entry, found := treeCache.GetEntry(status.file)
 	if false == found {
 		return false
 	}
@@ -499,84 +1114,251 @@ func (m *Model) isBlockStillNeeded(status *blockPullStatus) bool {
 	return false
 }
 
-func (m *Model) pullBlock(status *blockPullStatus, addToCache bool) {
-	m.fmut.RLock()
-	m.pmut.RLock()
-	status.cv.L.Lock()
+// pullBlock pulls a block for everyone waiting on it, then caches it, or
+// pins it for pinned files. Every pull is run by exactly one worker, which
+// holds no locks while it waits for peers.
+func (m *Model) pullBlock(status *blockPullStatus) {
+	m.fmut.Lock()
 
-	requestError := errors.New("can't get block from any devices")
+	status.cv.L.Lock()
+	status.state = assigned
+	status.cv.L.Unlock()
 
-	if done != status.state {
-		devices, _ := m.treeCaches[status.folder].GetEntryDevices(status.file)
-		conns := make([]connections.Connection, 0)
-		for _, deviceIndex := range rand.Perm(len(devices)) {
-			deviceWithFile := devices[deviceIndex]
-			if conn, ok := m.protoConn[deviceWithFile]; ok {
-				conns = append(conns, conn)
-			}
+	fbc, ok := m.blockCaches[status.folder]
+	if ok && (fbc.HasCachedBlockData(status.block.Hash) || fbc.HasPinnedBlock(status.block.Hash)) {
+		// stored meanwhile, e.g. by a read of another file with the block
+		data, found := fbc.GetCachedBlockData(status.block.Hash)
+		if found {
+			m.finishPullUnsafe(status, data, nil)
+			m.fmut.Unlock()
+			return
 		}
-		m.fmut.RUnlock()
-		m.pmut.RUnlock()
+	}
+	if status.priority == pullPriorityPin && false == m.isBlockStillNeeded(status) {
+		m.finishPullUnsafe(status, nil, errPullAbandoned)
+		m.fmut.Unlock()
+		return
+	}
 
-		if debug {
-			l.Debugln(status.comment, "block at offset", status.offset, "size", status.block.Size, "for", status.folder, status.file)
+	var devices []protocol.DeviceID
+	if treeCache, ok := m.treeCaches[status.folder]; ok {
+		devices, _ = treeCache.GetEntryDevices(status.file)
+	}
+	connectedDevices := make([]protocol.DeviceID, 0)
+	m.pmut.RLock()
+	for _, deviceWithFile := range devices {
+		if _, ok := m.protoConn[deviceWithFile]; ok {
+			connectedDevices = append(connectedDevices, deviceWithFile)
 		}
+	}
+	m.pmut.RUnlock()
+	m.fmut.Unlock()
+
+	if debug {
+		l.Debugln(status.comment, "block at offset", status.offset, "size", status.block.Size, "for", status.folder, status.file)
+	}
+
+	data, err := m.requestBlockFromDevices(status, connectedDevices)
+
+	m.fmut.Lock()
+	m.finishPullUnsafe(status, data, err)
+	m.fmut.Unlock()
+}
+
+// requestBlockFromDevices asks the devices for a block, best first, until
+// one sends it.
+func (m *Model) requestBlockFromDevices(status *blockPullStatus, devices []protocol.DeviceID) ([]byte, error) {
+	requestError := errors.New("can't get block from any devices")
+	var requestedData []byte
 
-		var requestedData []byte
+	for len(devices) > 0 {
+		released := m.peers.released()
+		busy := make([]protocol.DeviceID, 0)
+
+		for _, deviceWithFile := range m.peers.order(devices, int(status.block.Size)) {
+			if status.isAbandoned() {
+				return nil, errPullAbandoned
+			}
+
+			request, ok := m.peers.begin(deviceWithFile)
+			if !ok {
+				// try the next device, and come back if nobody else has it
+				busy = append(busy, deviceWithFile)
+				continue
+			}
 
-		for _, conn := range conns {
 			if debug {
-				l.Debugln("Trying to fetch block at offset", status.offset, "for", status.folder, status.file, "from device", conn.ID().String()[:5])
+				l.Debugln("Trying to fetch block at offset", status.offset, "for", status.folder, status.file, "from device", deviceWithFile.String()[:5])
+			}
+
+			// pins are limited separately from reads, until a read asks for them
+			if false == m.limits.wait(deviceWithFile, int64(status.block.Size), m.isPinPull(status), status.abandon, status.raised) {
+				m.peers.end(request, 0, errPullAbandoned)
+				return nil, errPullAbandoned
 			}
 
-			requestedData, requestError = conn.Request(status.folder, status.file, status.offset, int(status.block.Size), status.block.Hash, false)
+			requestedData, requestError = m.requestBlock(deviceWithFile, status)
 			if requestError == nil {
 				// check hash
 				actualHash := sha256.Sum256(requestedData)
-				if bytes.Equal(actualHash[:], status.block.Hash) {
-					break
-				} else {
+				if false == bytes.Equal(actualHash[:], status.block.Hash) {
 					requestError = errors.New(fmt.Sprint("Hash mismatch expected", status.block.Hash, "received", actualHash))
 				}
 			}
-		}
+			m.peers.end(request, len(requestedData), requestError)
 
-		status.state = done
-		status.error = requestError
-		status.data = requestedData
+			if requestError == nil {
+				return requestedData, nil
+			}
+		}
 
-		status.cv.Broadcast()
-	} else {
-		m.fmut.RUnlock()
-		m.pmut.RUnlock()
+		devices = busy
+		if len(devices) > 0 {
+			select {
+			case <-released:
+			case <-status.abandon:
+				return nil, errPullAbandoned
+			}
+		}
 	}
 
+	return nil, requestError
+}
+
+// finishPullUnsafe hands the outcome of a pull to the reads waiting for it,
+// and stores the block.
+// requires fmut write lock before entry
+func (m *Model) finishPullUnsafe(status *blockPullStatus, data []byte, err error) {
+	status.cv.L.Lock()
+	status.state = done
+	status.error = err
+	status.data = data
+	close(status.finished)
+	status.cv.Broadcast()
 	status.cv.L.Unlock()
 
-	m.fmut.Lock()
-	status.mutex.RLock()
+	pinned := false
+	if fbc, ok := m.blockCaches[status.folder]; ok {
+		needed := status.pin && m.isBlockStillNeeded(status)
+		pinned = err == nil && needed
+		switch {
+		case err == nil && needed:
+			fbc.PinNewBlock(status.block, data)
+			m.pinSucceededUnsafe(status.folder, status.file)
+			m.pmut.RLock()
+			m.markIndexChanged(status.folder, status.file)
+			m.pmut.RUnlock()
+		case err == nil:
+			fbc.AddCachedFileData(status.block, data)
+		case needed && err != errPullAbandoned:
+			m.schedulePinRetryUnsafe(status.folder, status.file)
+		}
+	}
+	if status.pin {
+		m.finishPinFillUnsafe(status, pinned)
+	}
+
+	m.readAheadInFlight -= status.readAheadBytes
+	status.readAheadBytes = 0
+
 	hash := b64.URLEncoding.EncodeToString(status.block.Hash)
-	if requestError == nil && addToCache {
-		m.blockCaches[status.folder].AddCachedFileData(status.block, status.data)
+	if m.pulls[status.folder][hash] == status {
+		delete(m.pulls[status.folder], hash)
 	}
-	delete(m.pulls[status.folder], hash)
-	m.fmut.Unlock()
-	status.mutex.RUnlock()
+}
+
+func (status *blockPullStatus) isAbandoned() bool {
+	select {
+	case <-status.abandon:
+		return true
+	default:
+		return false
+	}
+}
+
+type requestResult struct {
+	data []byte
+	err  error
+}
+
+// requestBlock asks a device for a block. If the connection used goes away
+// while the request is in flight, e.g. when a relay connection is upgraded to
+// a direct one, the request moves to the device's new connection.
+func (m *Model) requestBlock(deviceID protocol.DeviceID, status *blockPullStatus) ([]byte, error) {
+	var used protocol.Connection
+	requestError := errDeviceNotConnected
+
+	for attempt := 0; attempt < maxRequestAttempts; attempt++ {
+		m.pmut.RLock()
+		conn, ok := m.protoConn[deviceID]
+		m.pmut.RUnlock()
+		if !ok || conn.Connection == used {
+			// no new connection to move to
+			break
+		}
+		used = conn.Connection
+
+		// the request itself cannot be cancelled, so stop waiting for it
+		results := make(chan requestResult, 1)
+		go func(conn connections.Connection) {
+			data, err := conn.Request(status.folder, status.file, status.offset, int(status.block.Size), status.block.Hash, false)
+			results <- requestResult{data: data, err: err}
+		}(conn)
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if d := m.cfg.Raw().Options.GetReadTimeout(); d > 0 {
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var result requestResult
+		select {
+		case result = <-results:
+		case <-status.abandon:
+			result.err = errPullAbandoned
+		case <-timeout:
+			result.err = ErrReadTimeout
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if result.err == nil {
+			return result.data, nil
+		}
+		requestError = result.err
+
+		if debug {
+			l.Debugln("Fetching block at offset", status.offset, "for", status.folder, status.file, "from device", deviceID.String()[:5], "failed:", requestError)
+		}
+
+		if requestError == errPullAbandoned || requestError == ErrReadTimeout {
+			// the connection is stalled, not gone, so move on to the next device
+			break
+		}
+	}
+
+	return nil, requestError
 }
 
 func (m *Model) GetChildren(folder string, path string) []protocol.FileInfo {
 	m.fmut.RLock()
+	defer m.fmut.RUnlock()
 
 	// TODO assert is directory?
 
-	entries := m.treeCaches[folder].GetChildren(path)
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return make([]protocol.FileInfo, 0)
+	}
+
+	entries := treeCache.GetChildren(path)
 	result := make([]protocol.FileInfo, len(entries))
 	for i, childPath := range entries {
-		result[i], _ = m.treeCaches[folder].GetEntry(childPath)
+		result[i], _ = treeCache.GetEntry(childPath)
 	}
 
-	m.fmut.RUnlock()
-
 	return result
 }
 
@@ -591,10 +1373,111 @@ func (m *Model) isFolderSharedWithDevice(folder string, deviceID protocol.Device
 }
 
 func (m *Model) isFilePinned(folder string, filename string) bool {
-	pins := m.pinnedFiles[folder]
-	i := sort.SearchStrings(pins, filename)
+	rules, ok := m.pinRules[folder]
+	return ok && rules.matches(filename)
+}
+
+// getPinnedEntries returns the files and symlinks matching the pin rules.
+// requires fmut read (or better) lock before entry
+func (m *Model) getPinnedEntries(folder string) []protocol.FileInfo {
+	entries := make([]protocol.FileInfo, 0)
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok || m.pinRules[folder].isEmpty() {
+		return entries
+	}
+
+	// only the parts of the folder that rules can match are looked at
+	for _, root := range m.pinRules[folder].roots() {
+		candidates := treeCache.GetEntriesBelow(root)
+		if entry, found := treeCache.GetEntry(root); found {
+			candidates = append(candidates, entry)
+		}
+		for _, entry := range candidates {
+			if false == entry.IsDirectory() && m.isFilePinned(folder, entry.Name) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries
+}
+
+// requires fmut read (or better) lock before entry
+func (m *Model) isFileFullyPinned(folder string, entry protocol.FileInfo) bool {
+	if false == m.isFilePinned(folder, entry.Name) {
+		return false
+	}
+
+	for _, block := range entry.Blocks {
+		if false == m.blockCaches[folder].HasPinnedBlock(block.Hash) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requires fmut read (or better) lock before entry
+func (m *Model) localFileInfo(folder string, entry protocol.FileInfo) protocol.FileInfo {
+	if entry.IsDirectory() || m.isFileFullyPinned(folder, entry) || m.isLocallyAuthored(folder, entry.Name) {
+		return entry
+	}
+
+	// we don't reliably hold this file, so make sure peers never ask us for it
+	entry.Invalid = true
+	entry.Blocks = nil
+	return entry
+}
+
+// getLocalIndex describes everything we hold locally for a folder, suitable
+// for sending to peers.
+func (m *Model) getLocalIndex(folder string) []protocol.FileInfo {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return make([]protocol.FileInfo, 0)
+	}
+
+	entries := treeCache.GetEntries()
+	for i, entry := range entries {
+		entries[i] = m.localFileInfo(folder, entry)
+	}
 
-	return i < len(pins) && pins[i] == filename
+	return append(entries, treeCache.GetDeletedEntries()...)
+}
+
+// getLocalFileInfos describes the named files we hold locally for a folder,
+// suitable for sending to peers. Files deleted remotely are skipped.
+func (m *Model) getLocalFileInfos(folder string, names map[string]bool) []protocol.FileInfo {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	result := make([]protocol.FileInfo, 0, len(names))
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return result
+	}
+
+	for name := range names {
+		if entry, found := treeCache.GetEntry(name); found {
+			result = append(result, m.localFileInfo(folder, entry))
+		} else if deleted, found := treeCache.GetDeletedEntry(name); found {
+			result = append(result, deleted)
+		}
+	}
+
+	return result
+}
+
+// requires pmut read (or better) lock before entry
+func (m *Model) markIndexChanged(folder string, name string) {
+	for _, sender := range m.indexSenders {
+		sender.markChanged(folder, name)
+	}
 }
 
 // An index was received from the peer device
@@ -656,7 +1539,20 @@ func (m *Model) updateIndex(deviceID protocol.DeviceID, folder string, files []p
 		return
 	}
 
+	changedFiles := make([]string, 0)
+
 	for _, file := range files {
+		if deleted, wasDeleted := treeCache.GetDeletedEntry(file.Name); wasDeleted {
+			ordering := file.Version.Compare(deleted.Version)
+			if ordering == protocol.Lesser || ordering == protocol.Equal {
+				if debug {
+					l.Debugln("peer", deviceID.String()[:5], "has file we deleted locally, ignoring", file.Name)
+				}
+				continue
+			}
+			treeCache.RemoveDeletedEntry(file.Name)
+		}
+
 		entry, existsInLocalModel := treeCache.GetEntry(file.Name)
 
 		var globalToLocal protocol.Ordering
@@ -669,68 +1565,182 @@ func (m *Model) updateIndex(deviceID protocol.DeviceID, folder string, files []p
 		}
 
 		// remove if necessary
+		removed := false
 		if existsInLocalModel && (globalToLocal == protocol.Greater || (file.Version.Concurrent(entry.Version) && file.WinsConflict(entry))) {
 			if debug {
 				l.Debugln("remove entry for", file.Name, "from", deviceID.String()[:5])
 			}
 
-			treeCache.RemoveEntry(file.Name)
-
-			if m.isFilePinned(folder, file.Name) {
+			if m.isFilePinned(folder, file.Name) || m.isLocallyAuthored(folder, file.Name) {
 				for _, block := range entry.Blocks {
 					fbc.UnpinBlock(block.Hash)
 				}
 			}
+
+			treeCache.RemoveEntry(file.Name)
+			changedFiles = append(changedFiles, file.Name)
+			removed = true
 		}
 
 		// add if necessary
 		if !existsInLocalModel || (globalToLocal == protocol.Greater || (file.Version.Concurrent(entry.Version) && file.WinsConflict(entry))) || (globalToLocal == protocol.Equal) {
-			if file.IsDeleted() {
+			if file.IsDeleted() && removed {
+				// we advertised the file, so advertise its deletion too
 				if debug {
-					l.Debugln("peer", deviceID.String()[:5], "has deleted file, doing nothing", file.Name)
+					l.Debugln("peer", deviceID.String()[:5], "deleted file, remembering deletion", file.Name)
 				}
+				treeCache.AddDeletedEntry(file)
 				continue
 			}
-			if file.IsInvalid() {
+			if file.IsDeleted() {
 				if debug {
-					l.Debugln("peer", deviceID.String()[:5], "has invalid file, doing nothing", file.Name)
+					l.Debugln("peer", deviceID.String()[:5], "has deleted file, doing nothing", file.Name)
 				}
 				continue
 			}
-			if file.IsSymlink() {
+			if file.IsInvalid() {
 				if debug {
-					l.Debugln("peer", deviceID.String()[:5], "has symlink, doing nothing", file.Name)
+					l.Debugln("peer", deviceID.String()[:5], "has invalid file, doing nothing", file.Name)
 				}
 				continue
 			}
 
 			if debug && file.IsDirectory() {
 				l.Debugln("add directory", file.Name, "from", deviceID.String()[:5])
+			} else if debug && file.IsSymlink() {
+				l.Debugln("add symlink", file.Name, "from", deviceID.String()[:5])
 			} else if debug {
 				l.Debugln("add file", file.Name, "from", deviceID.String()[:5])
 			}
 
 			treeCache.AddEntry(file, deviceID)
+			changedFiles = append(changedFiles, file.Name)
 
 			// trigger pull on unsatisfied blocks for pinned files
 			if m.isFilePinned(folder, file.Name) {
-				for i, block := range file.Blocks {
-					if false == fbc.HasPinnedBlock(block.Hash) {
-						blockStart := int64(i * protocol.BlockSize)
-						status := m.getOrCreatePullStatus("Pin fetch", folder, file.Name, block, blockStart, queued)
-						m.pinnedList.PushBack(status)
-					}
-				}
+				m.queuePinnedFileUnsafe(folder, file)
 			}
 		}
 	}
 
+	m.pmut.RLock()
+	for _, changedFile := range changedFiles {
+		m.markIndexChanged(folder, changedFile)
+	}
+	if len(changedFiles) > 0 {
+		for _, handler := range m.changeHandlers {
+			go handler(folder, changedFiles)
+		}
+	}
+	m.pmut.RUnlock()
+
 	m.lmut.Broadcast()
 }
 
+// OnChange registers a handler for files changed by peers.
+func (m *Model) OnChange(handler ChangeHandler) {
+	m.pmut.Lock()
+	m.changeHandlers = append(m.changeHandlers, handler)
+	m.pmut.Unlock()
+}
+
 // A request was made by the peer device
 func (m *Model) Request(deviceID protocol.DeviceID, folder string, name string, offset int64, hash []byte, fromTemporary bool, buf []byte) error {
-	return protocol.ErrNoSuchFile
+	if debug {
+		l.Debugln("model: request from device", deviceID.String()[:5], "for", folder, name, "at offset", offset, "size", len(buf))
+	}
+
+	m.fmut.RLock()
+	data, block, err := m.readRequestedBlockRUnsafe(deviceID, folder, name, offset, hash, len(buf))
+	fbc := m.blockCaches[folder]
+	m.fmut.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// never hand out data we can't vouch for. Hashing takes a while, so it's
+	// done without holding any lock.
+	actualHash := sha256.Sum256(data)
+	if false == bytes.Equal(actualHash[:], block.Hash) {
+		l.Warnln("Cached block at offset", offset, "for", folder, name, "is corrupt, refusing request")
+		return protocol.ErrNoSuchFile
+	}
+
+	// serving the block counts as using it, which the cache has to record
+	m.fmut.Lock()
+	if m.blockCaches[folder] == fbc {
+		fbc.TouchBlock(block.Hash)
+	}
+	m.fmut.Unlock()
+
+	copy(buf, data)
+
+	return nil
+}
+
+// readRequestedBlockRUnsafe looks up the block a peer asked for, and reads it
+// from the cache without marking it as used.
+// requires fmut read (or better) lock before entry
+func (m *Model) readRequestedBlockRUnsafe(deviceID protocol.DeviceID, folder string, name string, offset int64, hash []byte, size int) ([]byte, protocol.BlockInfo, error) {
+	if false == m.isFolderSharedWithDevice(folder, deviceID) {
+		if debug {
+			l.Debugln("model:", deviceID.String()[:5], "not shared with folder", folder, "so refusing request")
+		}
+		return nil, protocol.BlockInfo{}, protocol.ErrNoSuchFile
+	}
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return nil, protocol.BlockInfo{}, protocol.ErrNoSuchFile
+	}
+	fbc, ok := m.blockCaches[folder]
+	if !ok {
+		return nil, protocol.BlockInfo{}, protocol.ErrNoSuchFile
+	}
+
+	entry, found := treeCache.GetEntry(name)
+	if false == found || entry.IsDirectory() {
+		return nil, protocol.BlockInfo{}, protocol.ErrNoSuchFile
+	}
+
+	block, found := getBlockAtOffset(entry, offset, hash)
+	if false == found {
+		if debug {
+			l.Debugln("model: no block at offset", offset, "with requested hash for", folder, name)
+		}
+		return nil, protocol.BlockInfo{}, protocol.ErrNoSuchFile
+	}
+	if size != int(block.Size) {
+		return nil, protocol.BlockInfo{}, protocol.ErrInvalid
+	}
+
+	data, found := fbc.ReadCachedBlockData(block.Hash)
+	if false == found {
+		if debug {
+			l.Debugln("model: block at offset", offset, "not cached for", folder, name)
+		}
+		return nil, protocol.BlockInfo{}, protocol.ErrNoSuchFile
+	}
+
+	return data, block, nil
+}
+
+func getBlockAtOffset(entry protocol.FileInfo, offset int64, hash []byte) (protocol.BlockInfo, bool) {
+	if offset < 0 || offset%protocol.BlockSize != 0 {
+		return protocol.BlockInfo{}, false
+	}
+
+	i := offset / protocol.BlockSize
+	if i >= int64(len(entry.Blocks)) {
+		return protocol.BlockInfo{}, false
+	}
+
+	block := entry.Blocks[i]
+	if false == bytes.Equal(block.Hash, hash) {
+		return protocol.BlockInfo{}, false
+	}
+
+	return block, true
 }
 
 // A cluster configuration message was received
@@ -749,8 +1759,22 @@ func (m *Model) Closed(conn protocol.Connection, err error) {
 	deviceID := conn.ID()
 
 	m.pmut.Lock()
+	defer m.pmut.Unlock()
+
+	current, ok := m.protoConn[deviceID]
+	if !ok || current.Connection != conn {
+		// a connection we already replaced
+		if debug {
+			l.Debugln("model: replaced connection to", deviceID.String()[:5], "closed:", err)
+		}
+		return
+	}
+
 	delete(m.protoConn, deviceID)
-	m.pmut.Unlock()
+	if sender, ok := m.indexSenders[deviceID]; ok {
+		sender.Stop()
+		delete(m.indexSenders, deviceID)
+	}
 }
 
 func (m *Model) GetPinsStatusByFolder() map[string]string {
@@ -759,18 +1783,16 @@ func (m *Model) GetPinsStatusByFolder() map[string]string {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 
-	for fldr, files := range m.pinnedFiles {
+	for fldr := range m.pinRules {
 		pendingBytes := uint64(0)
 		pendingFileCount := 0
 		pinnedBytes := uint64(0)
 		pinnedFileCount := 0
 		fbc := m.blockCaches[fldr]
-		tc := m.treeCaches[fldr]
 
-		for _, file := range files {
+		for _, fileEntry := range m.getPinnedEntries(fldr) {
 			pending := false
 
-			fileEntry, _ := tc.GetEntry(file)
 			for _, block := range fileEntry.Blocks {
 				if false == fbc.HasPinnedBlock(block.Hash) {
 					pending = true
@@ -809,9 +1831,171 @@ func (m *Model) GetPinsStatusByFolder() map[string]string {
 	return result
 }
 
+// GetOwnership returns the user and group ids that files in the folder
+// appear to belong to.
+func (m *Model) GetOwnership(folder string) (uint32, uint32) {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	ownership, ok := m.ownership[folder]
+	if !ok {
+		return uint32(os.Getuid()), uint32(os.Getgid())
+	}
+	return ownership.uid, ownership.gid
+}
+
+// IsOfflineOnly returns true if the folder should only show files stored
+// locally.
+func (m *Model) IsOfflineOnly(folder string) bool {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	return m.offlineOnly[folder]
+}
+
+// IsFileLocal returns true if the entry can be read without any peers:
+// directories, files being written, and files with all blocks cached or
+// pinned.
+func (m *Model) IsFileLocal(folder string, entry protocol.FileInfo) bool {
+	if entry.IsDirectory() {
+		return true
+	}
+
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	if _, ok := m.staged[folder][entry.Name]; ok {
+		return true
+	}
+
+	fbc, ok := m.blockCaches[folder]
+	if !ok {
+		return false
+	}
+	return fbc.HasAllBlocks(entry.Blocks)
+}
+
+// IsFilePinned returns true if the file, or directory, matches a pin rule.
+func (m *Model) IsFilePinned(folder string, path string) bool {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	return m.isFilePinned(folder, path)
+}
+
+// SetFilePinned pins or unpins a file, or everything below a directory, by
+// changing the pin rules of the folder. Files pinned by another rule, e.g. a
+// pattern, cannot be unpinned on their own.
+func (m *Model) SetFilePinned(folder string, path string, pinned bool) error {
+	if _, found := m.GetEntry(folder, path); !found && path != "" {
+		return protocol.ErrNoSuchFile
+	}
+
+	// the rules are changed inside the wrapper, so concurrent changes, e.g.
+	// from the GUI, aren't lost
+	changed := false
+	err := m.cfg.Modify(func(to *config.Configuration) bool {
+		for i := range to.Folders {
+			if to.Folders[i].ID != folder {
+				continue
+			}
+
+			// the whole folder can only be named by a pattern
+			if path == "" {
+				to.Folders[i].PinnedPatterns, changed = setRule(to.Folders[i].PinnedPatterns, "**", pinned)
+			} else {
+				to.Folders[i].PinnedFiles, changed = setRule(to.Folders[i].PinnedFiles, path, pinned)
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return err
+	}
+
+	if false == changed {
+		if false == pinned && m.IsFilePinned(folder, path) {
+			return ErrPinnedByRule
+		}
+		return nil
+	}
+
+	return m.cfg.Save()
+}
+
+// setRule adds or removes a pin rule, returning the sorted rules and whether
+// they changed.
+func setRule(rules []string, rule string, pinned bool) ([]string, bool) {
+	result := make([]string, 0, len(rules)+1)
+	listed := false
+	for _, r := range rules {
+		if r == rule {
+			listed = true
+			if false == pinned {
+				continue
+			}
+		}
+		result = append(result, r)
+	}
+
+	if pinned && !listed {
+		result = append(result, rule)
+	}
+	sort.Strings(result)
+	return result, pinned != listed
+}
+
+// GetCachedBytes returns how many bytes of the file, or of the files below
+// the directory, are stored locally.
+func (m *Model) GetCachedBytes(folder string, path string) int64 {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return 0
+	}
+	fbc := m.blockCaches[folder]
+
+	entry, found := treeCache.GetEntry(path)
+	entries := []protocol.FileInfo{entry}
+	if path == "" || (found && entry.IsDirectory()) {
+		entries = treeCache.GetEntriesBelow(path)
+	}
+
+	cachedBytes := int64(0)
+	for _, entry := range entries {
+		for _, block := range entry.Blocks {
+			if fbc.HasPinnedBlock(block.Hash) || fbc.HasCachedBlockData(block.Hash) {
+				cachedBytes += int64(block.Size)
+			}
+		}
+	}
+
+	return cachedBytes
+}
+
+// GetEntryDevices returns the devices that announced the current version of
+// the file.
+func (m *Model) GetEntryDevices(folder string, path string) []protocol.DeviceID {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return []protocol.DeviceID{}
+	}
+
+	devices, _ := treeCache.GetEntryDevices(path)
+	return devices
+}
+
 type ConnectionInfo struct {
-	DeviceID string
-	Address  string
+	DeviceID   string
+	Address    string
+	Latency    time.Duration // of block requests, on average
+	Throughput int64         // bytes per second, on average
+	Failures   int           // block requests failed since the last success
 }
 
 func (m *Model) GetConnections() []ConnectionInfo {
@@ -820,12 +2004,103 @@ func (m *Model) GetConnections() []ConnectionInfo {
 
 	connections := make([]ConnectionInfo, 0)
 	for _, conn := range m.protoConn {
+		stats := m.peers.get(conn.ID())
 		ci := ConnectionInfo{
-			DeviceID: conn.ID().String(),
-			Address:  conn.RemoteAddr().String(),
+			DeviceID:   conn.ID().String(),
+			Address:    conn.RemoteAddr().String(),
+			Latency:    stats.latency,
+			Throughput: int64(stats.throughput),
+			Failures:   stats.failures,
 		}
 		connections = append(connections, ci)
 	}
 
 	return connections
 }
+
+type CacheInfo struct {
+	Folder       string
+	CachedBytes  int64
+	MaximumBytes int64
+}
+
+func (m *Model) GetCacheUsage() []CacheInfo {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	usage := make([]CacheInfo, 0, len(m.blockCaches))
+	for folder, fbc := range m.blockCaches {
+		ci := CacheInfo{
+			Folder:       folder,
+			CachedBytes:  fbc.CachedBytes(),
+			MaximumBytes: fbc.MaximumBytes(),
+		}
+		usage = append(usage, ci)
+	}
+
+	return usage
+}
+
+// GetCacheCapacity returns the most bytes the caches may hold together, and
+// how many they hold now.
+func (m *Model) GetCacheCapacity() (int64, int64) {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	var maximum, cached int64
+	for _, fbc := range m.blockCaches {
+		maximum += fbc.MaximumBytes()
+		cached += fbc.CachedBytes()
+	}
+	if m.cacheBudget != nil {
+		maximum = m.cacheBudget.MaximumBytes()
+	}
+
+	return maximum, cached
+}
+
+// GetGlobalSize returns the bytes and number of all files and directories
+// announced in all folders.
+func (m *Model) GetGlobalSize() (int64, int64) {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	var bytes, files int64
+	for _, treeCache := range m.treeCaches {
+		folderBytes, folderFiles := treeCache.GetSize()
+		bytes += folderBytes
+		files += folderFiles
+	}
+
+	return bytes, files
+}
+
+type PullInfo struct {
+	Folder  string
+	File    string
+	Offset  int64
+	Comment string
+}
+
+// GetPulls returns the blocks waiting to be pulled or being pulled.
+func (m *Model) GetPulls() []PullInfo {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	pulls := make([]PullInfo, 0)
+	for _, folderPulls := range m.pulls {
+		for _, status := range folderPulls {
+			// these fields never change, so the status lock isn't needed. it
+			// may be held for the whole pull.
+			pi := PullInfo{
+				Folder:  status.folder,
+				File:    status.file,
+				Offset:  status.offset,
+				Comment: status.comment,
+			}
+			pulls = append(pulls, pi)
+		}
+	}
+
+	return pulls
+}
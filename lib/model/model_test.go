@@ -1,15 +1,24 @@
 package model
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	b64 "encoding/base64"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/burkemw3/syncthingfuse/lib/config"
 	stconfig "github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/connections"
 	"github.com/syncthing/syncthing/lib/protocol"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -215,8 +224,9 @@ func TestModelSingleIndexUpdate(t *testing.T) {
 	assertContainsChild(t, children, "file2dir", protocol.FileInfoTypeDirectory)
 	assertContainsChild(t, children, "dir1", protocol.FileInfoTypeDirectory)
 	assertContainsChild(t, children, "dir2file", 0)
-	if len(children) != 4 {
-		t.Error("expected 4 children, but got", len(children))
+	assertContainsChild(t, children, "file2symlink", protocol.FileInfoTypeSymlinkFile)
+	if len(children) != 5 {
+		t.Error("expected 5 children, but got", len(children))
 	}
 
 	children = model.GetChildren(folder, "dir1")
@@ -232,6 +242,1504 @@ func TestModelSingleIndexUpdate(t *testing.T) {
 	assertEntry(t, model, folder, "dir1/dirfile1", 0)
 	assertEntry(t, model, folder, "dir1/dirfile2", 0)
 	assertEntry(t, model, folder, "dir2file", 0)
+	assertEntry(t, model, folder, "file2symlink", protocol.FileInfoTypeSymlinkFile)
+}
+
+func TestGlobalSizeFollowsIndex(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	version := protocol.Vector{Counters: []protocol.Counter{{1, 0}}}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Size: 100, Version: version},
+		protocol.FileInfo{Name: "dir1", Type: protocol.FileInfoTypeDirectory, Version: version},
+		protocol.FileInfo{Name: "dir1/dirfile1", Size: 20, Version: version},
+		protocol.FileInfo{Name: "dir1/dirfile2", Size: 3, Version: version},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	version = protocol.Vector{Counters: []protocol.Counter{{1, 1}}}
+	files = []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Size: 50, Version: version},
+		protocol.FileInfo{Name: "dir1", Deleted: true, Type: protocol.FileInfoTypeDirectory, Version: version},
+	}
+	model.IndexUpdate(deviceBob, folder, files)
+
+	// Assert
+	bytes, count := model.GetGlobalSize()
+	if bytes != 50 || count != 1 {
+		t.Error("expected 50 bytes in 1 file, but got", bytes, count)
+	}
+
+	model = NewModel(cfg, database)
+	bytes, count = model.GetGlobalSize()
+	if bytes != 50 || count != 1 {
+		t.Error("expected 50 bytes in 1 file after restart, but got", bytes, count)
+	}
+}
+
+func TestSymlinkTargetRemembered(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	target := []byte("../dir1/file1")
+	hash := sha256.Sum256(target)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(target))}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "link1", Type: protocol.FileInfoTypeSymlinkFile, Size: int64(len(target)), Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+	model.blockCaches[folder].AddCachedFileData(block, target)
+
+	// Act
+	actual, err := model.GetSymlinkTarget(context.Background(), folder, "link1")
+
+	// Assert
+	if err != nil || actual != string(target) {
+		t.Error("expected target", string(target), "but got", actual, err)
+	}
+	stored, found := model.treeCaches[folder].GetSymlinkTarget("link1")
+	if false == found || stored != string(target) {
+		t.Error("expected target to be stored, but got", stored, found)
+	}
+}
+
+func TestRequestServesCachedBlock(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob, deviceCarol)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Size: int64(len(data)), Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+	model.blockCaches[folder].AddCachedFileData(block, data)
+
+	// Act
+	buf := make([]byte, len(data))
+	err := model.Request(deviceCarol, folder, "file1", 0, hash[:], false, buf)
+
+	// Assert
+	if err != nil {
+		t.Error("expected block to be served, but got", err)
+	}
+	if false == bytes.Equal(buf, data) {
+		t.Error("served data", buf, "does not match cached data", data)
+	}
+}
+
+func TestRequestRefusesUncachedBlock(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob, deviceCarol)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Size: int64(len(data)), Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	buf := make([]byte, len(data))
+	uncachedErr := model.Request(deviceCarol, folder, "file1", 0, hash[:], false, buf)
+	wrongOffsetErr := model.Request(deviceCarol, folder, "file1", protocol.BlockSize, hash[:], false, buf)
+	unknownFileErr := model.Request(deviceCarol, folder, "file2", 0, hash[:], false, buf)
+	unsharedErr := model.Request(deviceAlice, folder, "file1", 0, hash[:], false, buf)
+
+	// Assert
+	if uncachedErr != protocol.ErrNoSuchFile {
+		t.Error("expected uncached block to be refused, but got", uncachedErr)
+	}
+	if wrongOffsetErr != protocol.ErrNoSuchFile {
+		t.Error("expected block at wrong offset to be refused, but got", wrongOffsetErr)
+	}
+	if unknownFileErr != protocol.ErrNoSuchFile {
+		t.Error("expected unknown file to be refused, but got", unknownFileErr)
+	}
+	if unsharedErr != protocol.ErrNoSuchFile {
+		t.Error("expected unshared device to be refused, but got", unsharedErr)
+	}
+}
+
+func TestLocalIndexAdvertisesOnlyPinnedFiles(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].PinnedFiles = []string{"pinnedFile", "pendingFile"}
+	model := NewModel(cfg, database)
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	otherHash := sha256.Sum256([]byte("other"))
+	otherBlock := protocol.BlockInfo{Hash: otherHash[:], Size: 5}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "pinnedFile", Blocks: []protocol.BlockInfo{block}},
+		protocol.FileInfo{Name: "pendingFile", Blocks: []protocol.BlockInfo{otherBlock}},
+		protocol.FileInfo{Name: "cachedFile", Blocks: []protocol.BlockInfo{block}},
+		protocol.FileInfo{Name: "dir1", Type: protocol.FileInfoTypeDirectory},
+	}
+	model.Index(deviceBob, folder, files)
+	model.blockCaches[folder].PinNewBlock(block, data)
+
+	// Act
+	index := model.getLocalIndex(folder)
+
+	// Assert
+	if len(index) != 4 {
+		t.Error("expected 4 index entries, but got", len(index))
+	}
+	for _, file := range index {
+		expectInvalid := file.Name == "pendingFile" || file.Name == "cachedFile"
+		if file.Invalid != expectInvalid {
+			t.Error("expected invalid", expectInvalid, "for", file.Name, "but got", file.Invalid)
+		}
+	}
+}
+
+func TestWriteAnnouncesNewVersion(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+
+	// Act
+	model.CreateFile(folder, "file1")
+	model.WriteFileData(folder, "file1", 0, data)
+	model.ReleaseFile(folder, "file1")
+
+	// Assert
+	entry, found := model.GetEntry(folder, "file1")
+	if false == found {
+		t.Fatal("expected written file to exist")
+	}
+	if entry.Size != int64(len(data)) {
+		t.Error("expected size", len(data), "but got", entry.Size)
+	}
+	if len(entry.Version.Counters) != 1 || entry.Version.Counters[0].ID != deviceAlice.Short() {
+		t.Error("expected version authored by local device, but got", entry.Version)
+	}
+
+	buf := make([]byte, len(data))
+	err := model.Request(deviceBob, folder, "file1", 0, hash[:], false, buf)
+	if err != nil || false == bytes.Equal(buf, data) {
+		t.Error("expected peer to be served written data, but got", err)
+	}
+
+	index := model.getLocalIndex(folder)
+	if len(index) != 1 || index[0].Invalid {
+		t.Error("expected written file to be advertised, but got", index)
+	}
+}
+
+func TestRenamedStagedFileKeepsData(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	data := []byte("dead beef")
+	model.CreateFile(folder, "file1")
+	model.WriteFileData(folder, "file1", 0, data)
+
+	// Act
+	renameErr := model.Rename(folder, "file1", "file2")
+	createErr := model.CreateFile(folder, "file1")
+	model.ReleaseFile(folder, "file2")
+	model.ReleaseFile(folder, "file1")
+
+	// Assert
+	if renameErr != nil || createErr != nil {
+		t.Error("expected rename and create, but got", renameErr, createErr)
+	}
+	entry, found := model.GetEntry(folder, "file2")
+	if false == found || entry.Size != int64(len(data)) {
+		t.Error("expected renamed file to keep its", len(data), "bytes, but got", entry.Size)
+	}
+	read, err := model.GetFileData(context.Background(), folder, "file2", 0, len(data))
+	if err != nil || false == bytes.Equal(read, data) {
+		t.Error("expected renamed file data, but got", read, err)
+	}
+}
+
+func TestRenameOfUnstoredFileRefused(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	hash := sha256.Sum256([]byte("dead beef"))
+	block := protocol.BlockInfo{Hash: hash[:], Size: 9}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Size: 9, Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	err := model.Rename(folder, "file1", "file2")
+
+	// Assert
+	if err != ErrNotStoredLocally {
+		t.Error("expected rename to be refused, but got", err)
+	}
+	if _, found := model.GetEntry(folder, "file1"); false == found {
+		t.Error("expected file to keep its name")
+	}
+	if _, found := model.GetEntry(folder, "file2"); found {
+		t.Error("expected no file at the new name")
+	}
+	if index := model.getLocalIndex(folder); len(index) != 1 || index[0].Deleted {
+		t.Error("expected no deletion to be advertised, but got", index)
+	}
+}
+
+func TestRenameKeepsCachedBlocksUnpinned(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "dir1", Type: protocol.FileInfoTypeDirectory},
+		protocol.FileInfo{Name: "dir1/file1", Size: 9, Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+	model.blockCaches[folder].AddCachedFileData(block, data)
+
+	// Act
+	err := model.Rename(folder, "dir1", "dir2")
+
+	// Assert
+	if err != nil {
+		t.Error("expected rename, but got", err)
+	}
+	if _, found := model.GetEntry(folder, "dir2/file1"); false == found {
+		t.Error("expected file under the new name")
+	}
+	if model.blockCaches[folder].HasPinnedBlock(block.Hash) {
+		t.Error("expected renamed block to stay cached, not pinned")
+	}
+}
+
+func TestRenamedDirectoryKeepsStagedWrites(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "dir1", Type: protocol.FileInfoTypeDirectory},
+	}
+	model.Index(deviceBob, folder, files)
+
+	data := []byte("dead beef")
+	model.CreateFile(folder, "dir1/file1")
+	model.WriteFileData(folder, "dir1/file1", 0, data)
+
+	// Act
+	err := model.Rename(folder, "dir1", "dir2")
+	more := []byte(" and more")
+	model.WriteFileData(folder, "dir2/file1", int64(len(data)), more)
+	model.ReleaseFile(folder, "dir2/file1")
+
+	// Assert
+	if err != nil {
+		t.Error("expected rename, but got", err)
+	}
+	expected := append(data, more...)
+	entry, found := model.GetEntry(folder, "dir2/file1")
+	if false == found || entry.Size != int64(len(expected)) {
+		t.Fatal("expected renamed file to keep its writes, but got", found, entry.Size)
+	}
+	read, err := model.GetFileData(context.Background(), folder, "dir2/file1", 0, len(expected))
+	if err != nil || false == bytes.Equal(read, expected) {
+		t.Error("expected renamed file data, but got", read, err)
+	}
+	if _, found := model.GetEntry(folder, "dir1/file1"); found {
+		t.Error("expected nothing left under the old name")
+	}
+}
+
+func TestRemoveAnnouncesDeletion(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	version := protocol.Vector{Counters: []protocol.Counter{{1, 0}}}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Version: version},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	err := model.Remove(folder, "file1")
+	model.Index(deviceBob, folder, files)
+
+	// Assert
+	if err != nil {
+		t.Error("expected removal, but got", err)
+	}
+	if _, found := model.GetEntry(folder, "file1"); found {
+		t.Error("expected removed file to stay removed")
+	}
+
+	index := model.getLocalIndex(folder)
+	if len(index) != 1 || false == index[0].Deleted || index[0].Version.Compare(version) != protocol.Greater {
+		t.Error("expected deletion to be advertised, but got", index)
+	}
+}
+
+func TestRemoteDeletionAdvertised(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	version := protocol.Vector{Counters: []protocol.Counter{{1, 0}}}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Version: version},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	version = protocol.Vector{Counters: []protocol.Counter{{1, 1}}}
+	files = []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Deleted: true, Version: version},
+	}
+	model.IndexUpdate(deviceBob, folder, files)
+
+	// Assert
+	index := model.getLocalIndex(folder)
+	if len(index) != 1 || false == index[0].Deleted || index[0].Version.Compare(version) != protocol.Equal {
+		t.Error("expected remote deletion to be advertised, but got", index)
+	}
+	update := model.getLocalFileInfos(folder, map[string]bool{"file1": true})
+	if len(update) != 1 || false == update[0].Deleted {
+		t.Error("expected remote deletion in index update, but got", update)
+	}
+}
+
+func TestIndexSequencesSurviveRestart(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	first := model.reserveSequences(folder, 3)
+
+	// Act
+	model = NewModel(cfg, database)
+	next := model.reserveSequences(folder, 1)
+
+	// Assert
+	if first != 1 || next != 4 {
+		t.Error("expected sequences 1 then 4, but got", first, next)
+	}
+}
+
+func TestConfigChangeAppliedWithoutRestart(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1"},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	to := cfg.Raw()
+	to.Folders = []config.FolderConfiguration{
+		config.FolderConfiguration{
+			ID:        "addedfolder",
+			CacheSize: "1MiB",
+			Devices:   []stconfig.FolderDeviceConfiguration{stconfig.FolderDeviceConfiguration{DeviceID: deviceCarol}},
+		},
+	}
+	err := cfg.Replace(to)
+
+	// Assert
+	if err != nil {
+		t.Error("expected config to be accepted, but got", err)
+	}
+	if cfg.RequiresRestart() {
+		t.Error("expected folder changes to not require restart")
+	}
+	if model.HasFolder(folder) {
+		t.Error("expected folder", folder, "to be removed")
+	}
+	if false == model.HasFolder("addedfolder") {
+		t.Error("expected folder addedfolder to be added")
+	}
+
+	model.Index(deviceCarol, "addedfolder", files)
+	assertEntry(t, model, "addedfolder", "file1", 0)
+}
+
+func TestPinRulesMatchDirectoriesAndPatterns(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].PinnedFiles = []string{"Photos/2024"}
+	cfg.Raw().Folders[0].PinnedPatterns = []string{"*.pdf"}
+	model := NewModel(cfg, database)
+
+	blocks := make([]protocol.BlockInfo, 4)
+	for i := range blocks {
+		hash := sha256.Sum256([]byte{byte(i)})
+		blocks[i] = protocol.BlockInfo{Hash: hash[:], Size: 5}
+	}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "Photos/2024/a.jpg", Blocks: []protocol.BlockInfo{blocks[0]}},
+		protocol.FileInfo{Name: "Photos/2023/b.jpg", Blocks: []protocol.BlockInfo{blocks[1]}},
+		protocol.FileInfo{Name: "docs/c.pdf", Blocks: []protocol.BlockInfo{blocks[2]}},
+		protocol.FileInfo{Name: "notes.txt", Blocks: []protocol.BlockInfo{blocks[3]}},
+	}
+
+	// Act
+	model.Index(deviceBob, folder, files)
+
+	// Assert
+	status := model.GetPinsStatusByFolder()[folder]
+	if status != "2 files (10 B) pending" {
+		t.Error("expected 2 files pending, but got", status)
+	}
+}
+
+func TestPinRuleRootsSkipNestedPaths(t *testing.T) {
+	// Arrange
+	rules := newPinRules([]string{"Photos/2024", "Music/Album [Disc 1]"}, []string{"Photos/**/*.jpg", "Music/*/cover.png"})
+	anywhere := newPinRules([]string{"Photos"}, []string{"*.pdf"})
+
+	// Act
+	roots := rules.roots()
+	anywhereRoots := anywhere.roots()
+
+	// Assert
+	if len(roots) != 2 || roots[0] != "Music" || roots[1] != "Photos" {
+		t.Error("expected roots Music and Photos, but got", roots)
+	}
+	if len(anywhereRoots) != 1 || anywhereRoots[0] != "" {
+		t.Error("expected only the folder root, but got", anywhereRoots)
+	}
+}
+
+func TestCachedBytesOnlyCountsSubtree(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	blocks := make([]protocol.BlockInfo, 3)
+	for i := range blocks {
+		data := []byte{byte(i), byte(i), byte(i)}
+		hash := sha256.Sum256(data)
+		blocks[i] = protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+		model.blockCaches[folder].AddCachedFileData(blocks[i], data)
+	}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "Photos", Type: protocol.FileInfoTypeDirectory},
+		protocol.FileInfo{Name: "Photos/a.jpg", Blocks: []protocol.BlockInfo{blocks[0]}},
+		protocol.FileInfo{Name: "Photos/2024/b.jpg", Blocks: []protocol.BlockInfo{blocks[1]}},
+		protocol.FileInfo{Name: "Photos2/c.jpg", Blocks: []protocol.BlockInfo{blocks[2]}},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	dirBytes := model.GetCachedBytes(folder, "Photos")
+	fileBytes := model.GetCachedBytes(folder, "Photos/a.jpg")
+	rootBytes := model.GetCachedBytes(folder, "")
+
+	// Assert
+	if dirBytes != 6 {
+		t.Error("expected 6 bytes cached below Photos, but got", dirBytes)
+	}
+	if fileBytes != 3 {
+		t.Error("expected 3 bytes cached for Photos/a.jpg, but got", fileBytes)
+	}
+	if rootBytes != 9 {
+		t.Error("expected 9 bytes cached in the folder, but got", rootBytes)
+	}
+}
+
+func TestRemovedPinRuleReleasesBlocks(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].PinnedPatterns = []string{"Photos/**"}
+	model := NewModel(cfg, database)
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "Photos/2024/a.jpg", Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+	model.blockCaches[folder].PinNewBlock(block, data)
+
+	// Act
+	to := cfg.Raw()
+	to.Folders = []config.FolderConfiguration{to.Folders[0]}
+	to.Folders[0].PinnedPatterns = []string{}
+	cfg.Replace(to)
+
+	// Assert
+	if model.blockCaches[folder].HasPinnedBlock(block.Hash) {
+		t.Error("expected block to be unpinned with its rule")
+	}
+}
+
+func TestSetFilePinned(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].PinnedPatterns = []string{"*.pdf"}
+	model := NewModel(cfg, database)
+
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1"},
+		protocol.FileInfo{Name: "file2.pdf"},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	pinErr := model.SetFilePinned(folder, "file1", true)
+	pinned := model.IsFilePinned(folder, "file1")
+	unpinErr := model.SetFilePinned(folder, "file1", false)
+	unpinned := false == model.IsFilePinned(folder, "file1")
+	ruleErr := model.SetFilePinned(folder, "file2.pdf", false)
+
+	// Assert
+	if pinErr != nil || false == pinned {
+		t.Error("expected file1 to be pinned, but got", pinErr)
+	}
+	if unpinErr != nil || false == unpinned {
+		t.Error("expected file1 to be unpinned, but got", unpinErr)
+	}
+	if ruleErr != ErrPinnedByRule {
+		t.Error("expected file2.pdf to stay pinned by its pattern, but got", ruleErr)
+	}
+	if rules := cfg.Raw().Folders[0].PinnedFiles; len(rules) != 0 {
+		t.Error("expected no pinned paths to remain, but got", rules)
+	}
+	if rules := cfg.Raw().Folders[0].PinnedPatterns; len(rules) != 1 || rules[0] != "*.pdf" {
+		t.Error("expected only the pattern rule to remain, but got", rules)
+	}
+}
+
+func TestConcurrentPinsAllKept(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	names := []string{"file1", "file2", "file3", "file4", "file5", "file6", "file7", "file8"}
+	files := make([]protocol.FileInfo, len(names))
+	for i, name := range names {
+		files[i] = protocol.FileInfo{Name: name}
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			model.SetFilePinned(folder, name, true)
+		}(name)
+	}
+	wg.Wait()
+
+	// Assert
+	if rules := cfg.Raw().Folders[0].PinnedFiles; len(rules) != len(names) {
+		t.Error("expected every pin to be kept, but got", rules)
+	}
+	for _, name := range names {
+		if false == model.IsFilePinned(folder, name) {
+			t.Error("expected", name, "to be pinned")
+		}
+	}
+}
+
+func TestPinnedPathsTakenLiterally(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].PinnedFiles = []string{"Music/Album [Disc 1]/01.flac"}
+	model := NewModel(cfg, database)
+
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "Music/Album [Disc 1]/01.flac"},
+		protocol.FileInfo{Name: "Music/Album D/01.flac"},
+		protocol.FileInfo{Name: "Music/Album [Disc 2]/01.flac"},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	pinErr := model.SetFilePinned(folder, "Music/Album [Disc 2]/01.flac", true)
+
+	// Assert
+	if false == model.IsFilePinned(folder, "Music/Album [Disc 1]/01.flac") {
+		t.Error("expected bracketed path to pin its own file")
+	}
+	if model.IsFilePinned(folder, "Music/Album D/01.flac") {
+		t.Error("expected bracketed path not to be taken as a pattern")
+	}
+	if pinErr != nil || false == model.IsFilePinned(folder, "Music/Album [Disc 2]/01.flac") {
+		t.Error("expected bracketed file to be pinned, but got", pinErr)
+	}
+}
+
+func TestOwnershipMappedPerFolder(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].Owner = "1234"
+	model := NewModel(cfg, database)
+
+	// Act
+	uid, gid := model.GetOwnership(folder)
+
+	// Assert
+	if uid != 1234 {
+		t.Error("expected uid 1234, but got", uid)
+	}
+	if gid != uint32(os.Getgid()) {
+		t.Error("expected gid of current process", os.Getgid(), "but got", gid)
+	}
+}
+
+func TestChangeHandlerToldAboutPeerChanges(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	changes := make(chan []string, 1)
+	model.OnChange(func(changedFolder string, files []string) {
+		if changedFolder == folder {
+			changes <- files
+		}
+	})
+
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1"},
+	}
+
+	// Act
+	model.Index(deviceBob, folder, files)
+
+	// Assert
+	select {
+	case changed := <-changes:
+		if len(changed) != 1 || changed[0] != "file1" {
+			t.Error("expected file1 to be changed, but got", changed)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected change handler to be called")
+	}
+}
+
+func TestIsFileLocal(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].OfflineOnly = true
+	model := NewModel(cfg, database)
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	otherHash := sha256.Sum256([]byte("other"))
+	otherBlock := protocol.BlockInfo{Hash: otherHash[:], Size: 5}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "cachedFile", Blocks: []protocol.BlockInfo{block}},
+		protocol.FileInfo{Name: "partialFile", Blocks: []protocol.BlockInfo{block, otherBlock}},
+		protocol.FileInfo{Name: "dir1", Type: protocol.FileInfoTypeDirectory},
+	}
+	model.Index(deviceBob, folder, files)
+	model.blockCaches[folder].AddCachedFileData(block, data)
+
+	// Act
+	cachedLocal := model.IsFileLocal(folder, files[0])
+	partialLocal := model.IsFileLocal(folder, files[1])
+	dirLocal := model.IsFileLocal(folder, files[2])
+
+	// Assert
+	if false == model.IsOfflineOnly(folder) {
+		t.Error("expected folder to be offline only")
+	}
+	if false == cachedLocal {
+		t.Error("expected cached file to be local")
+	}
+	if partialLocal {
+		t.Error("expected partially cached file to not be local")
+	}
+	if false == dirLocal {
+		t.Error("expected directory to be local")
+	}
+}
+
+func TestFolderMountPointRequiresRestart(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, _ := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	from := cfg.Raw()
+	to := cfg.Raw()
+	to.Folders = append([]config.FolderConfiguration(nil), from.Folders...)
+	to.Folders[0].MountPoint = path.Join(dir, "own-mount")
+
+	// Act
+	applied := model.CommitConfiguration(from, to)
+
+	// Assert
+	if applied {
+		t.Error("expected a new folder mount point to require a restart")
+	}
+}
+
+func TestTimedOutReadAbandonsPull(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+
+	hash := sha256.Sum256([]byte("dead beef"))
+	block := protocol.BlockInfo{Hash: hash[:], Size: 9}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Size: 9, Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// a pull that never finishes, as with a stalled peer
+	var mutex sync.RWMutex
+	stalled := &blockPullStatus{
+		folder:      folder,
+		file:        "file1",
+		block:       block,
+		state:       assigned,
+		mutex:       &mutex,
+		cv:          sync.NewCond(&mutex),
+		finished:    make(chan struct{}),
+		abandon:     make(chan struct{}),
+		abandonable: true,
+	}
+	model.pulls[folder][b64.URLEncoding.EncodeToString(hash[:])] = stalled
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// Act
+	_, err := model.GetFileData(ctx, folder, "file1", 0, 9)
+
+	// Assert
+	if err != ErrReadTimeout {
+		t.Error("expected read to time out, but got", err)
+	}
+	if false == stalled.isAbandoned() {
+		t.Error("expected pull to be abandoned")
+	}
+	if _, ok := model.pulls[folder][b64.URLEncoding.EncodeToString(hash[:])]; ok {
+		t.Error("expected abandoned pull to be forgotten")
+	}
+}
+
+func TestReadAheadGrowsForSequentialReads(t *testing.T) {
+	// Arrange
+	ra := NewReadAhead()
+	maximum := int64(8 * protocol.BlockSize)
+
+	// Act
+	var window int64
+	for offset := int64(0); offset < 10*protocol.BlockSize; offset += protocol.BlockSize {
+		window = ra.update(offset, protocol.BlockSize, maximum)
+	}
+
+	// Assert
+	if window != maximum {
+		t.Error("expected window to grow to", maximum, "but got", window)
+	}
+}
+
+func TestReadAheadShrinksForRandomReads(t *testing.T) {
+	// Arrange
+	ra := NewReadAhead()
+	maximum := int64(8 * protocol.BlockSize)
+	for offset := int64(0); offset < 10*protocol.BlockSize; offset += protocol.BlockSize {
+		ra.update(offset, protocol.BlockSize, maximum)
+	}
+
+	// Act
+	window := ra.update(100*protocol.BlockSize, protocol.BlockSize, maximum)
+
+	// Assert
+	if window != readAheadMinimum {
+		t.Error("expected window to shrink to", readAheadMinimum, "but got", window)
+	}
+}
+
+func TestSiblingsOrderedByMtime(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "photos", Type: protocol.FileInfoTypeDirectory},
+		protocol.FileInfo{Name: "photos/a.jpg", ModifiedS: 30},
+		protocol.FileInfo{Name: "photos/b.jpg", ModifiedS: 10},
+		protocol.FileInfo{Name: "photos/c.jpg", ModifiedS: 20},
+		protocol.FileInfo{Name: "photos/album", Type: protocol.FileInfoTypeDirectory},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// Act
+	model.fmut.RLock()
+	siblings := model.getOrderedSiblingsUnsafe(folder, "photos", config.PrefetchOrderMtime)
+	model.fmut.RUnlock()
+
+	// Assert
+	expected := []string{"photos/b.jpg", "photos/c.jpg", "photos/a.jpg"}
+	if len(siblings) != len(expected) {
+		t.Fatal("expected", len(expected), "files, but got", siblings)
+	}
+	for i, name := range expected {
+		if siblings[i].Name != name {
+			t.Error("expected", name, "at", i, "but got", siblings[i].Name)
+		}
+	}
+}
+
+func TestSiblingOrderFollowsIndexChanges(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	version := protocol.Vector{Counters: []protocol.Counter{{1, 0}}}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "photos", Type: protocol.FileInfoTypeDirectory, Version: version},
+		protocol.FileInfo{Name: "photos/a.jpg", Version: version},
+		protocol.FileInfo{Name: "photos/c.jpg", Version: version},
+	}
+	model.Index(deviceBob, folder, files)
+	model.fmut.RLock()
+	model.getOrderedSiblingsUnsafe(folder, "photos", config.PrefetchOrderName)
+	model.fmut.RUnlock()
+
+	// Act
+	files = []protocol.FileInfo{
+		protocol.FileInfo{Name: "photos/b.jpg", Version: version},
+	}
+	model.IndexUpdate(deviceBob, folder, files)
+	model.fmut.RLock()
+	siblings := model.getOrderedSiblingsUnsafe(folder, "photos", config.PrefetchOrderName)
+	model.fmut.RUnlock()
+
+	// Assert
+	expected := []string{"photos/a.jpg", "photos/b.jpg", "photos/c.jpg"}
+	if len(siblings) != len(expected) {
+		t.Fatal("expected", len(expected), "files, but got", siblings)
+	}
+	for i, name := range expected {
+		if siblings[i].Name != name {
+			t.Error("expected", name, "at", i, "but got", siblings[i].Name)
+		}
+	}
+}
+
+func TestPeerSchedulerPrefersFastPeer(t *testing.T) {
+	// Arrange
+	peers := newPeerScheduler()
+	request, _ := peers.begin(deviceBob)
+	request.started = request.started.Add(-time.Second)
+	peers.end(request, protocol.BlockSize, nil)
+	request, _ = peers.begin(deviceCarol)
+	peers.end(request, protocol.BlockSize, nil)
+
+	// Act
+	order := peers.order([]protocol.DeviceID{deviceBob, deviceCarol}, protocol.BlockSize)
+
+	// Assert
+	if order[0] != deviceCarol {
+		t.Error("expected faster device first, but got", order)
+	}
+}
+
+func TestPeerSchedulerBacksOffFailingPeer(t *testing.T) {
+	// Arrange
+	peers := newPeerScheduler()
+	request, _ := peers.begin(deviceCarol)
+	peers.end(request, protocol.BlockSize, nil)
+	request, _ = peers.begin(deviceBob)
+	peers.end(request, 0, errDeviceNotConnected)
+
+	// Act
+	order := peers.order([]protocol.DeviceID{deviceBob, deviceCarol}, protocol.BlockSize)
+
+	// Assert
+	if order[0] != deviceCarol || order[1] != deviceBob {
+		t.Error("expected failing device last, but got", order)
+	}
+	if stats := peers.get(deviceBob); stats.failures != 1 || false == stats.retryAt.After(time.Now()) {
+		t.Error("expected failing device to back off, but got", stats)
+	}
+}
+
+func TestPeerSchedulerCountsThroughput(t *testing.T) {
+	// Arrange
+	peers := newPeerScheduler()
+	peers.peers[deviceBob] = &peerStats{latency: 10 * time.Millisecond, throughput: 100 * 1024}
+	peers.peers[deviceCarol] = &peerStats{latency: 50 * time.Millisecond, throughput: 10 * 1024 * 1024}
+
+	// Act
+	order := peers.order([]protocol.DeviceID{deviceBob, deviceCarol}, protocol.BlockSize)
+
+	// Assert
+	if order[0] != deviceCarol {
+		t.Error("expected higher throughput device first for a full block, but got", order)
+	}
+}
+
+func TestPeerSchedulerBusyPeerDoesNotBlock(t *testing.T) {
+	// Arrange
+	peers := newPeerScheduler()
+	peers.setLimit(1)
+	request, _ := peers.begin(deviceBob)
+	released := peers.released()
+
+	// Act
+	_, ok := peers.begin(deviceBob)
+
+	// Assert
+	if ok {
+		t.Error("expected busy device to refuse another request")
+	}
+	if _, ok := peers.begin(deviceCarol); !ok {
+		t.Error("expected other device to take the request")
+	}
+	peers.end(request, protocol.BlockSize, nil)
+	select {
+	case <-released:
+	default:
+		t.Error("expected ending a request to release its slot")
+	}
+	if _, ok := peers.begin(deviceBob); !ok {
+		t.Error("expected device to take requests again once one ended")
+	}
+}
+
+func TestReadsPulledBeforePins(t *testing.T) {
+	// Arrange
+	var mutex sync.Mutex
+	m := &Model{
+		lmut:               sync.NewCond(&mutex),
+		pullWorkers:        1,
+		pullWorkersMaximum: 4,
+	}
+	pin := &blockPullStatus{file: "pinned"}
+	prefetch := &blockPullStatus{file: "prefetched"}
+	read := &blockPullStatus{file: "read"}
+
+	m.lmut.L.Lock()
+	m.enqueuePullUnsafe(pin, pullPriorityPin)
+	m.enqueuePullUnsafe(prefetch, pullPriorityReadAhead)
+	m.enqueuePullUnsafe(read, pullPriorityRead)
+
+	// Act
+	first, _, _ := m.nextPullUnsafe()
+	second, _, _ := m.nextPullUnsafe()
+	third, _, _ := m.nextPullUnsafe()
+	m.lmut.L.Unlock()
+
+	// Assert
+	if first != read || second != prefetch || third != pin {
+		t.Error("expected read, prefetch, then pin, but got", first.file, second.file, third.file)
+	}
+}
+
+func TestReadDuringPinPullJoinsIt(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].PinnedFiles = []string{"file1"}
+	model := NewModel(cfg, database)
+	model.SetMeteredOverride(MeteredOn) // keeps workers off the pin
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Size: int64(len(data)), Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+
+	// take the pin pull, as a worker does before asking peers
+	model.lmut.L.Lock()
+	pin := model.takePullUnsafe(pullPriorityPin)
+	model.lmut.L.Unlock()
+
+	// Act
+	read := make(chan []byte)
+	go func() {
+		readData, _ := model.GetFileData(context.Background(), folder, "file1", 0, len(data))
+		read <- readData
+	}()
+	for joined := false; false == joined; {
+		time.Sleep(time.Millisecond)
+		model.fmut.RLock()
+		joined = pin.readers == 1
+		model.fmut.RUnlock()
+	}
+
+	model.lmut.L.Lock()
+	queued := model.pullQueues[pullPriorityRead].Len()
+	model.lmut.L.Unlock()
+
+	model.fmut.Lock()
+	model.finishPullUnsafe(pin, data, nil)
+	model.fmut.Unlock()
+	readData := <-read
+
+	// Assert
+	if queued != 0 {
+		t.Error("expected read to join the pin pull, but", queued, "pulls were queued")
+	}
+	if false == bytes.Equal(readData, data) {
+		t.Error("expected read to get the pinned block, but got", readData)
+	}
+	if false == model.blockCaches[folder].HasPinnedBlock(block.Hash) {
+		t.Error("expected block to be pinned")
+	}
+}
+
+func TestMeteredNetworkPausesPinsAndReadAhead(t *testing.T) {
+	// Arrange
+	var mutex sync.Mutex
+	m := &Model{
+		lmut:               sync.NewCond(&mutex),
+		pullWorkers:        1,
+		pullWorkersMaximum: 4,
+		meteredOverride:    MeteredAuto,
+	}
+	pin := &blockPullStatus{file: "pinned"}
+	prefetch := &blockPullStatus{file: "prefetched"}
+	read := &blockPullStatus{file: "read"}
+
+	m.lmut.L.Lock()
+	m.enqueuePullUnsafe(pin, pullPriorityPin)
+	m.enqueuePullUnsafe(prefetch, pullPriorityReadAhead)
+	m.enqueuePullUnsafe(read, pullPriorityRead)
+	m.lmut.L.Unlock()
+
+	// Act
+	m.SetMeteredOverride(MeteredOn)
+	m.lmut.L.Lock()
+	metered, _, _ := m.nextPullUnsafe()
+	paused := m.pullQueues[pullPriorityReadAhead].Len() + m.pullQueues[pullPriorityPin].Len()
+	m.lmut.L.Unlock()
+
+	m.SetMeteredOverride(MeteredAuto)
+	m.lmut.L.Lock()
+	resumed, _, _ := m.nextPullUnsafe()
+	m.lmut.L.Unlock()
+
+	// Assert
+	if metered != read {
+		t.Error("expected read while metered, but got", metered.file)
+	}
+	if paused != 2 {
+		t.Error("expected pin and prefetch to stay queued while metered, but", paused, "are")
+	}
+	if resumed != prefetch {
+		t.Error("expected prefetch once no longer metered, but got", resumed.file)
+	}
+	if err := m.SetMeteredOverride("sometimes"); err == nil {
+		t.Error("expected unknown override to be rejected")
+	}
+}
+
+func TestReadLiftsPinLimit(t *testing.T) {
+	// Arrange
+	limits := newPullLimits()
+	limits.configure(config.OptionsConfiguration{MaxPinRecvKbps: 1})
+	var mutex sync.Mutex
+	m := &Model{lmut: sync.NewCond(&mutex)}
+	status := &blockPullStatus{priority: pullPriorityPin, raised: make(chan struct{})}
+	waited := make(chan bool)
+	go func() {
+		waited <- limits.wait(deviceBob, protocol.BlockSize, m.isPinPull(status), make(chan struct{}), status.raised)
+	}()
+
+	// Act
+	m.lmut.L.Lock()
+	m.reprioritizePullUnsafe(status, pullPriorityRead)
+	m.lmut.L.Unlock()
+
+	// Assert
+	select {
+	case ok := <-waited:
+		if false == ok {
+			t.Error("expected pull to go ahead")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected read to lift the pin limit")
+	}
+	if m.isPinPull(status) {
+		t.Error("expected pull to no longer count as a pin")
+	}
+}
+
+func TestPendingPinsSurviveRestart(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].PinnedFiles = []string{"pinnedFile", "filledFile"}
+	model := NewModel(cfg, database)
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	otherHash := sha256.Sum256([]byte("other"))
+	otherBlock := protocol.BlockInfo{Hash: otherHash[:], Size: 5}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "pinnedFile", Blocks: []protocol.BlockInfo{otherBlock}},
+		protocol.FileInfo{Name: "filledFile", Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+	model.blockCaches[folder].PinNewBlock(block, data)
+
+	// Act
+	restarted := NewModel(cfg, database)
+	restarted.fmut.RLock()
+	pending := restarted.getPendingPinsUnsafe(folder)
+	restarted.fmut.RUnlock()
+
+	// Assert
+	if len(pending) != 1 || pending[0] != "pinnedFile" {
+		t.Error("expected only the unfilled pinned file to stay pending, but got", pending)
+	}
+}
+
+func TestFilledPinNoLongerPending(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, folder := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	cfg.Raw().Folders[0].PinnedFiles = []string{"file1"}
+	model := NewModel(cfg, database)
+	model.SetMeteredOverride(MeteredOn) // keeps workers off the pin
+
+	data := []byte("dead beef")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Hash: hash[:], Size: int32(len(data))}
+	files := []protocol.FileInfo{
+		protocol.FileInfo{Name: "file1", Size: int64(len(data)), Blocks: []protocol.BlockInfo{block}},
+	}
+	model.Index(deviceBob, folder, files)
+
+	model.fmut.Lock()
+	model.lmut.L.Lock()
+	pending := model.getPendingPinsUnsafe(folder)
+	model.resumePendingPinsUnsafe(folder, protocol.DeviceID{}) // as on reconnect
+	queued := model.pullQueues[pullPriorityPin].Len()
+	pin := model.takePullUnsafe(pullPriorityPin)
+	model.lmut.L.Unlock()
+	model.fmut.Unlock()
+
+	// Act
+	model.fmut.Lock()
+	model.finishPullUnsafe(pin, data, nil)
+	filled := model.getPendingPinsUnsafe(folder)
+	model.fmut.Unlock()
+
+	// Assert
+	if len(pending) != 1 {
+		t.Error("expected file to be pending, but got", pending)
+	}
+	if queued != 1 {
+		t.Error("expected resuming not to queue the pull again, but", queued, "are queued")
+	}
+	if len(filled) != 0 {
+		t.Error("expected filled file to no longer be pending, but got", filled)
+	}
+}
+
+func TestFailedPinRetriesBackOff(t *testing.T) {
+	// Arrange
+	m := &Model{
+		pinRetries: map[string]map[string]*pinRetry{"folder": make(map[string]*pinRetry)},
+	}
+
+	// Act
+	m.schedulePinRetryUnsafe("folder", "file")
+	m.schedulePinRetryUnsafe("folder", "file")
+	retry := m.pinRetries["folder"]["file"]
+	m.cancelPinRetryUnsafe("folder", "file")
+	m.schedulePinRetryUnsafe("folder", "file")
+	m.cancelPinRetryUnsafe("folder", "file")
+
+	// Assert
+	if retry.failures != 2 {
+		t.Error("expected failures while waiting to retry to count once, but got", retry.failures)
+	}
+}
+
+func TestPinsOnlyPulledInSchedule(t *testing.T) {
+	// Arrange
+	m := &Model{}
+	m.setPinScheduleUnsafe(config.OptionsConfiguration{PinSchedule: "22:00-07:00"})
+	day := func(hour int) time.Time {
+		return time.Date(2017, 3, 1, hour, 30, 0, 0, time.Local)
+	}
+
+	// Act
+	night := m.isPinningScheduledUnsafe(day(23))
+	morning := m.isPinningScheduledUnsafe(day(3))
+	noon := m.isPinningScheduledUnsafe(day(12))
+
+	// Assert
+	if false == night || false == morning || noon {
+		t.Error("expected pins pulled only at night, but got", night, morning, noon)
+	}
+}
+
+func TestRateLimitedPullAbandoned(t *testing.T) {
+	// Arrange
+	limits := newPullLimits()
+	limits.configure(config.OptionsConfiguration{
+		DeviceRateLimits: []config.DeviceRateLimit{{DeviceID: deviceBob, MaxRecvKbps: 1}},
+	})
+	abandon := make(chan struct{})
+	close(abandon)
+
+	// Act
+	unlimited := limits.wait(deviceCarol, protocol.BlockSize, true, abandon, nil)
+	limited := limits.wait(deviceBob, protocol.BlockSize, true, abandon, nil)
+
+	// Assert
+	if false == unlimited {
+		t.Error("expected pull from unlimited device to go ahead")
+	}
+	if limited {
+		t.Error("expected pull from limited device to wait, and be abandoned")
+	}
+}
+
+func TestSecondConnectionKeepsPreferred(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, _ := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	first, firstPeer := newFakeConnection(deviceBob, 20)
+	model.AddConnection(first, protocol.HelloResult{})
+
+	// Act
+	better, betterPeer := newFakeConnection(deviceBob, 10)
+	model.AddConnection(better, protocol.HelloResult{})
+	worse, worsePeer := newFakeConnection(deviceBob, 30)
+	model.AddConnection(worse, protocol.HelloResult{})
+
+	// Assert
+	model.pmut.RLock()
+	current := model.protoConn[deviceBob]
+	model.pmut.RUnlock()
+	if current.Connection != better.Connection {
+		t.Error("expected preferred connection to be kept")
+	}
+	assertRawConnClosed(t, firstPeer, true)
+	assertRawConnClosed(t, worsePeer, true)
+	assertRawConnClosed(t, betterPeer, false)
+}
+
+func TestEqualConnectionKeepsExisting(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, _ := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	first, firstPeer := newFakeConnection(deviceBob, 10)
+	setFakeLatency(first, 20*time.Millisecond)
+	model.AddConnection(first, protocol.HelloResult{})
+
+	// Act
+	second, secondPeer := newFakeConnection(deviceBob, 10)
+	setFakeLatency(second, 20*time.Millisecond)
+	model.AddConnection(second, protocol.HelloResult{})
+
+	// Assert
+	model.pmut.RLock()
+	current := model.protoConn[deviceBob]
+	model.pmut.RUnlock()
+	if current.Connection != first.Connection {
+		t.Error("expected existing connection to be kept")
+	}
+	assertRawConnClosed(t, firstPeer, false)
+	assertRawConnClosed(t, secondPeer, true)
+}
+
+func TestFasterConnectionReplacesEqualPriority(t *testing.T) {
+	// init
+	dir, _ := ioutil.TempDir("", "stf-mt")
+	defer os.RemoveAll(dir)
+	cfg, database, _ := setup(deviceAlice, dir, deviceBob)
+
+	// Arrange
+	model := NewModel(cfg, database)
+	slow, slowPeer := newFakeConnection(deviceBob, 10)
+	setFakeLatency(slow, 200*time.Millisecond)
+	model.AddConnection(slow, protocol.HelloResult{})
+
+	// Act
+	fast, fastPeer := newFakeConnection(deviceBob, 10)
+	setFakeLatency(fast, 10*time.Millisecond)
+	model.AddConnection(fast, protocol.HelloResult{})
+
+	// Assert
+	model.pmut.RLock()
+	current := model.protoConn[deviceBob]
+	model.pmut.RUnlock()
+	if current.Connection != fast.Connection {
+		t.Error("expected faster connection to replace existing one")
+	}
+	assertRawConnClosed(t, slowPeer, true)
+	assertRawConnClosed(t, fastPeer, false)
+}
+
+func TestIsPreferredConnection(t *testing.T) {
+	// Arrange
+	direct, _ := newFakeConnection(deviceBob, 10)
+	relay, _ := newFakeConnection(deviceBob, 200)
+	other, _ := newFakeConnection(deviceBob, 10)
+
+	// Act
+	overRelay := isPreferredConnection(direct, relay, time.Second, time.Millisecond)
+	underDirect := isPreferredConnection(relay, direct, time.Millisecond, time.Second)
+	equal := isPreferredConnection(other, direct, 10*time.Millisecond, 10*time.Millisecond)
+	unmeasured := isPreferredConnection(other, direct, 0, 0)
+	oldUnanswered := isPreferredConnection(other, direct, 10*time.Millisecond, 0)
+	faster := isPreferredConnection(other, direct, 10*time.Millisecond, 50*time.Millisecond)
+
+	// Assert
+	if false == overRelay || underDirect {
+		t.Error("expected lower priority to win regardless of latency")
+	}
+	if equal || unmeasured {
+		t.Error("expected existing connection kept on a tie")
+	}
+	if false == oldUnanswered || false == faster {
+		t.Error("expected clearly faster connection to win")
+	}
 }
 
 func assertContainsChild(t *testing.T, children []protocol.FileInfo, name string, infoType protocol.FileInfoType) {
@@ -259,6 +1767,72 @@ func assertEntry(t *testing.T, model *Model, folder string, name string, infoTyp
 	t.Error("incorrect entry for file", name)
 }
 
+// fakeConnection is a connection to a device that accepts whatever the model
+// sends, and answers requests after latency. Other methods are left to the nil
+// protocol.Connection.
+type fakeConnection struct {
+	protocol.Connection
+	id      protocol.DeviceID
+	latency time.Duration
+}
+
+func newFakeConnection(deviceID protocol.DeviceID, priority int) (connections.Connection, net.Conn) {
+	raw, peer := net.Pipe()
+	conn := connections.Connection{
+		IntermediateConnection: connections.IntermediateConnection{
+			Conn:     tls.Client(raw, &tls.Config{}),
+			Priority: priority,
+		},
+		Connection: &fakeConnection{id: deviceID},
+	}
+	return conn, peer
+}
+
+func (c *fakeConnection) Start() {}
+
+func (c *fakeConnection) ID() protocol.DeviceID {
+	return c.id
+}
+
+func (c *fakeConnection) ClusterConfig(config protocol.ClusterConfig) {}
+
+func (c *fakeConnection) Index(folder string, files []protocol.FileInfo) error {
+	return nil
+}
+
+func (c *fakeConnection) IndexUpdate(folder string, files []protocol.FileInfo) error {
+	return nil
+}
+
+func (c *fakeConnection) Request(folder string, name string, offset int64, size int, hash []byte, fromTemporary bool) ([]byte, error) {
+	time.Sleep(c.latency)
+	return nil, protocol.ErrNoSuchFile
+}
+
+func setFakeLatency(conn connections.Connection, latency time.Duration) {
+	conn.Connection.(*fakeConnection).latency = latency
+}
+
+// assertRawConnClosed reads from the other end of a raw connection, which
+// fails once the connection is closed.
+func assertRawConnClosed(t *testing.T, peer net.Conn, expected bool) {
+	read := make(chan error, 1)
+	go func() {
+		_, err := peer.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	closed := false
+	select {
+	case <-read:
+		closed = true
+	case <-time.After(100 * time.Millisecond):
+	}
+	if closed != expected {
+		t.Error("expected raw connection closed", expected, "but got", closed)
+	}
+}
+
 func setup(deviceID protocol.DeviceID, dir string, peers ...protocol.DeviceID) (*config.Wrapper, *bolt.DB, string) {
 	configFile, _ := ioutil.TempFile(dir, "config")
 	realCfg := config.New(deviceID, deviceID.String()[:5])
@@ -0,0 +1,237 @@
+package model
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+const (
+	peerStatsWeight    = 0.2 // of a new sample in moving averages
+	peerBackoffMinimum = time.Second
+	peerBackoffMaximum = 5 * time.Minute
+)
+
+// peerScheduler tracks how well each device serves blocks, so pulls ask the
+// fastest devices first, spread concurrent pulls over several devices, and
+// leave failing devices alone for a while.
+type peerScheduler struct {
+	mut   sync.Mutex
+	peers map[protocol.DeviceID]*peerStats
+	slots map[protocol.DeviceID]chan struct{} // limit requests in flight per device
+	limit int                                 // 0 for no limit
+	freed chan struct{}                       // closed when a slot is released
+}
+
+// peerRequest is a request in flight to a device.
+type peerRequest struct {
+	deviceID protocol.DeviceID
+	started  time.Time
+	slot     chan struct{} // released when the request ends
+}
+
+// peerStats describes the current connection to a device.
+type peerStats struct {
+	latency    time.Duration // moving average of block request round trips
+	throughput float64       // moving average of bytes per second
+	errorRate  float64       // moving average of failed requests, 0 to 1
+	failures   int           // failures since the last success
+	retryAt    time.Time     // not asked before then, after failures
+	inFlight   int
+}
+
+func newPeerScheduler() *peerScheduler {
+	return &peerScheduler{
+		peers: make(map[protocol.DeviceID]*peerStats),
+		slots: make(map[protocol.DeviceID]chan struct{}),
+		freed: make(chan struct{}),
+	}
+}
+
+// requires mut before entry
+func (ps *peerScheduler) statsUnsafe(deviceID protocol.DeviceID) *peerStats {
+	stats, ok := ps.peers[deviceID]
+	if !ok {
+		stats = &peerStats{}
+		ps.peers[deviceID] = stats
+	}
+	return stats
+}
+
+// reset forgets what was learned about a device, e.g. when it connects
+// again, possibly over a faster connection.
+func (ps *peerScheduler) reset(deviceID protocol.DeviceID) {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+
+	if stats, ok := ps.peers[deviceID]; ok {
+		ps.peers[deviceID] = &peerStats{inFlight: stats.inFlight}
+	}
+}
+
+// order returns devices best first for a request of the given size. Devices
+// backing off come last, so they are still asked when nobody else has the
+// block.
+func (ps *peerScheduler) order(devices []protocol.DeviceID, bytes int) []protocol.DeviceID {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+
+	now := time.Now()
+	ranked := peerRanking{
+		devices: make([]protocol.DeviceID, len(devices)),
+		costs:   make([]float64, len(devices)),
+		backoff: make([]bool, len(devices)),
+	}
+	// shuffle, so equally good devices share the load
+	for i, j := range rand.Perm(len(devices)) {
+		stats := ps.statsUnsafe(devices[j])
+		ranked.devices[i] = devices[j]
+		ranked.costs[i] = stats.costUnsafe(bytes)
+		ranked.backoff[i] = now.Before(stats.retryAt)
+	}
+	sort.Stable(ranked)
+
+	return ranked.devices
+}
+
+// costUnsafe estimates how long a new request of the given size takes,
+// waiting behind the requests in flight. Devices never asked cost nothing, so
+// they are tried.
+func (stats *peerStats) costUnsafe(bytes int) float64 {
+	transfer := 0.0
+	if stats.throughput > 0 {
+		transfer = float64(bytes) / stats.throughput
+	}
+	return (stats.latency.Seconds() + transfer) * float64(1+stats.inFlight) / (1 - math.Min(stats.errorRate, 0.9))
+}
+
+// setLimit changes how many requests may be in flight to each device.
+// Requests already in flight count against the old limit.
+func (ps *peerScheduler) setLimit(limit int) {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+
+	if limit != ps.limit {
+		ps.limit = limit
+		ps.slots = make(map[protocol.DeviceID]chan struct{})
+	}
+}
+
+// begin records a request to the device, if one may start now. It returns
+// false if the device has as many requests in flight as allowed, so the
+// caller can ask another device.
+func (ps *peerScheduler) begin(deviceID protocol.DeviceID) (*peerRequest, bool) {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+
+	slot, ok := ps.slots[deviceID]
+	if !ok && ps.limit > 0 {
+		slot = make(chan struct{}, ps.limit)
+		ps.slots[deviceID] = slot
+	}
+
+	if slot != nil {
+		select {
+		case slot <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+
+	ps.statsUnsafe(deviceID).inFlight += 1
+	return &peerRequest{deviceID: deviceID, started: time.Now(), slot: slot}, true
+}
+
+// released returns a channel closed when the next request slot frees up.
+func (ps *peerScheduler) released() <-chan struct{} {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+	return ps.freed
+}
+
+// end records the outcome of a request started by begin. Abandoned requests
+// say nothing about the device.
+func (ps *peerScheduler) end(request *peerRequest, bytes int, err error) {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+
+	if request.slot != nil {
+		<-request.slot
+		close(ps.freed)
+		ps.freed = make(chan struct{})
+	}
+
+	stats := ps.statsUnsafe(request.deviceID)
+	stats.inFlight -= 1
+
+	switch err {
+	case nil:
+		elapsed := time.Since(request.started)
+		throughput := float64(bytes) / math.Max(elapsed.Seconds(), 1e-6)
+		if stats.latency == 0 {
+			stats.latency = elapsed
+			stats.throughput = throughput
+		} else {
+			stats.latency = time.Duration(movingAverage(float64(stats.latency), float64(elapsed)))
+			stats.throughput = movingAverage(stats.throughput, throughput)
+		}
+		stats.errorRate = movingAverage(stats.errorRate, 0)
+		stats.failures = 0
+		stats.retryAt = time.Time{}
+	case errPullAbandoned:
+	default:
+		stats.errorRate = movingAverage(stats.errorRate, 1)
+		stats.failures += 1
+		backoff := peerBackoffMaximum
+		if stats.failures < 20 {
+			backoff = peerBackoffMinimum << uint(stats.failures-1)
+		}
+		if backoff > peerBackoffMaximum {
+			backoff = peerBackoffMaximum
+		}
+		stats.retryAt = time.Now().Add(backoff)
+	}
+}
+
+// get returns a copy of the stats of a device.
+func (ps *peerScheduler) get(deviceID protocol.DeviceID) peerStats {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+
+	if stats, ok := ps.peers[deviceID]; ok {
+		return *stats
+	}
+	return peerStats{}
+}
+
+func movingAverage(average float64, sample float64) float64 {
+	return (1-peerStatsWeight)*average + peerStatsWeight*sample
+}
+
+// peerRanking sorts devices by backoff, then cost.
+type peerRanking struct {
+	devices []protocol.DeviceID
+	costs   []float64
+	backoff []bool
+}
+
+func (pr peerRanking) Len() int {
+	return len(pr.devices)
+}
+
+func (pr peerRanking) Swap(i, j int) {
+	pr.devices[i], pr.devices[j] = pr.devices[j], pr.devices[i]
+	pr.costs[i], pr.costs[j] = pr.costs[j], pr.costs[i]
+	pr.backoff[i], pr.backoff[j] = pr.backoff[j], pr.backoff[i]
+}
+
+func (pr peerRanking) Less(i, j int) bool {
+	if pr.backoff[i] != pr.backoff[j] {
+		return pr.backoff[j]
+	}
+	return pr.costs[i] < pr.costs[j]
+}
@@ -0,0 +1,264 @@
+package model
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+const (
+	pinRetryMinimum = 10 * time.Second
+	pinRetryMaximum = time.Hour
+)
+
+// pendingPinsBucket lists, per folder, pinned files with blocks still to be
+// pulled, so filling them resumes after a restart.
+var pendingPinsBucket = []byte("pendingPins")
+
+// pinRetry is a pinned file that failed to pull, waiting to be queued again.
+type pinRetry struct {
+	failures int // since the file last pulled a block
+	timer    *time.Timer
+}
+
+// requires fmut write lock before entry
+func (m *Model) markPinPendingUnsafe(folder string, file string) {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(folder)).CreateBucketIfNotExists(pendingPinsBucket)
+		if err != nil {
+			return err
+		}
+		if b.Get([]byte(file)) != nil {
+			return nil
+		}
+		return b.Put([]byte(file), []byte{})
+	})
+	if err != nil {
+		l.Warnln("Cannot record pending pin of", folder, file, err)
+	}
+}
+
+// requires fmut write lock before entry
+func (m *Model) clearPinPendingUnsafe(folder string, files []string) {
+	if len(files) == 0 {
+		return
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		folderBucket := tx.Bucket([]byte(folder))
+		if folderBucket == nil {
+			return nil
+		}
+		b := folderBucket.Bucket(pendingPinsBucket)
+		if b == nil {
+			return nil
+		}
+		for _, file := range files {
+			if err := b.Delete([]byte(file)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		l.Warnln("Cannot clear pending pins of", folder, files, err)
+	}
+}
+
+// addPinFillUnsafe counts a pull towards filling a pinned file.
+// requires fmut write lock before entry
+func (m *Model) addPinFillUnsafe(status *blockPullStatus, file string) {
+	fills, ok := m.pinFills[status.folder]
+	if !ok {
+		return
+	}
+	status.pinFile = file
+	fills[file] += 1
+}
+
+// finishPinFillUnsafe counts a pull for a pinned file as done. Once the last
+// one pinned its block, and the file holds all of its blocks, it is no
+// longer pending.
+// requires fmut write lock before entry
+func (m *Model) finishPinFillUnsafe(status *blockPullStatus, pinned bool) {
+	fills, ok := m.pinFills[status.folder]
+	if !ok || status.pinFile == "" {
+		return
+	}
+
+	fills[status.pinFile] -= 1
+	if fills[status.pinFile] > 0 {
+		return
+	}
+	delete(fills, status.pinFile)
+
+	if false == pinned {
+		return
+	}
+	entry, found := m.treeCaches[status.folder].GetEntry(status.pinFile)
+	if found && m.blockCaches[status.folder].HasPinnedBlocks(entry.Blocks) {
+		if debug {
+			l.Debugln("Filled pin of", status.folder, status.pinFile)
+		}
+		m.clearPinPendingUnsafe(status.folder, []string{status.pinFile})
+	}
+}
+
+// requires fmut read lock (or better) before entry
+func (m *Model) getPendingPinsUnsafe(folder string) []string {
+	files := make([]string, 0)
+	m.db.View(func(tx *bolt.Tx) error {
+		folderBucket := tx.Bucket([]byte(folder))
+		if folderBucket == nil {
+			return nil
+		}
+		b := folderBucket.Bucket(pendingPinsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			files = append(files, string(k))
+			return nil
+		})
+	})
+	return files
+}
+
+// resumePendingPinsUnsafe queues the pending pins of a folder that the
+// device has, or all of them for the zero device ID. Files no longer pinned,
+// or already filled, are forgotten.
+// requires fmut and lmut write locks before entry (or exclusive access during init)
+func (m *Model) resumePendingPinsUnsafe(folder string, deviceID protocol.DeviceID) {
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return
+	}
+
+	done := make([]string, 0)
+	for _, file := range m.getPendingPinsUnsafe(folder) {
+		entry, found := treeCache.GetEntry(file)
+		if false == found || false == m.isFilePinned(folder, file) {
+			done = append(done, file)
+			continue
+		}
+
+		if deviceID != (protocol.DeviceID{}) {
+			devices, _ := treeCache.GetEntryDevices(file)
+			if false == containsDevice(devices, deviceID) {
+				continue
+			}
+		}
+
+		if debug {
+			l.Debugln("Resuming pin of", folder, file)
+		}
+		m.cancelPinRetryUnsafe(folder, file)
+		if false == m.queuePinnedFileUnsafe(folder, entry) {
+			done = append(done, file)
+		}
+	}
+
+	m.clearPinPendingUnsafe(folder, done)
+}
+
+// retryPinsFrom queues pending pins a device that just connected can serve.
+func (m *Model) retryPinsFrom(deviceID protocol.DeviceID) {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+	m.lmut.L.Lock()
+	defer m.lmut.L.Unlock()
+
+	for folder, devices := range m.folderDevices {
+		if containsDevice(devices, deviceID) {
+			m.resumePendingPinsUnsafe(folder, deviceID)
+		}
+	}
+}
+
+// schedulePinRetryUnsafe queues a pinned file again after it failed to pull,
+// waiting longer after each failure.
+// requires fmut write lock before entry
+func (m *Model) schedulePinRetryUnsafe(folder string, file string) {
+	retries, ok := m.pinRetries[folder]
+	if !ok {
+		return
+	}
+	retry, ok := retries[file]
+	if !ok {
+		retry = &pinRetry{}
+		retries[file] = retry
+	}
+	if retry.timer != nil {
+		// other blocks of the file failed, and are retried with it
+		return
+	}
+
+	backoff := pinRetryMaximum
+	if retry.failures < 20 {
+		backoff = pinRetryMinimum << uint(retry.failures)
+	}
+	if backoff > pinRetryMaximum {
+		backoff = pinRetryMaximum
+	}
+	retry.failures += 1
+
+	if debug {
+		l.Debugln("Retrying pin of", folder, file, "in", backoff)
+	}
+
+	retry.timer = time.AfterFunc(backoff, func() {
+		m.retryPin(folder, file, retry)
+	})
+}
+
+func (m *Model) retryPin(folder string, file string, retry *pinRetry) {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+	m.lmut.L.Lock()
+	defer m.lmut.L.Unlock()
+
+	// a reconnecting device may have queued the file already
+	if m.pinRetries[folder][file] != retry || retry.timer == nil {
+		return
+	}
+	retry.timer = nil
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return
+	}
+	entry, found := treeCache.GetEntry(file)
+	if false == found || false == m.isFilePinned(folder, file) {
+		delete(m.pinRetries[folder], file)
+		m.clearPinPendingUnsafe(folder, []string{file})
+		return
+	}
+
+	m.queuePinnedFileUnsafe(folder, entry)
+}
+
+// requires fmut write lock before entry
+func (m *Model) cancelPinRetryUnsafe(folder string, file string) {
+	if retry, ok := m.pinRetries[folder][file]; ok && retry.timer != nil {
+		retry.timer.Stop()
+		retry.timer = nil
+	}
+}
+
+// pinSucceededUnsafe forgets past failures of a file, once a block pulls.
+// requires fmut write lock before entry
+func (m *Model) pinSucceededUnsafe(folder string, file string) {
+	if retry, ok := m.pinRetries[folder][file]; ok && retry.timer == nil {
+		delete(m.pinRetries[folder], file)
+	}
+}
+
+func containsDevice(devices []protocol.DeviceID, deviceID protocol.DeviceID) bool {
+	for _, device := range devices {
+		if device == deviceID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// pinRules decides which files of a folder are pinned. Paths pin the file or
+// everything below the directory, and are taken literally, even if they look
+// like patterns. In patterns, "**" matches any number of directories, and
+// patterns without a slash match file names in any directory, e.g. "*.pdf".
+type pinRules struct {
+	paths    []string   // sorted
+	patterns [][]string // split on slashes
+}
+
+func newPinRules(paths []string, patterns []string) pinRules {
+	r := pinRules{
+		paths:    make([]string, 0),
+		patterns: make([][]string, 0),
+	}
+
+	for _, rule := range paths {
+		rule = strings.Trim(strings.TrimSpace(rule), "/")
+		if rule != "" {
+			r.paths = append(r.paths, rule)
+		}
+	}
+	sort.Strings(r.paths)
+
+	for _, rule := range patterns {
+		rule = strings.Trim(strings.TrimSpace(rule), "/")
+		if rule == "" {
+			continue
+		}
+		if false == strings.Contains(rule, "/") {
+			rule = "**/" + rule
+		}
+		r.patterns = append(r.patterns, strings.Split(rule, "/"))
+	}
+
+	return r
+}
+
+func (r pinRules) matches(name string) bool {
+	// the file itself, or any directory above it
+	for prefix := name; prefix != "." && prefix != "/" && prefix != ""; prefix = path.Dir(prefix) {
+		i := sort.SearchStrings(r.paths, prefix)
+		if i < len(r.paths) && r.paths[i] == prefix {
+			return true
+		}
+	}
+
+	segments := strings.Split(name, "/")
+	for _, pattern := range r.patterns {
+		if matchSegments(pattern, segments) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// roots returns the paths everything the rules match is at or below, without
+// any nested in another. The folder root is "".
+func (r pinRules) roots() []string {
+	candidates := make([]string, 0, len(r.paths)+len(r.patterns))
+	candidates = append(candidates, r.paths...)
+	for _, pattern := range r.patterns {
+		literal := make([]string, 0, len(pattern))
+		for _, segment := range pattern {
+			if segment == "**" || strings.ContainsAny(segment, "*?[\\") {
+				break
+			}
+			literal = append(literal, segment)
+		}
+		candidates = append(candidates, strings.Join(literal, "/"))
+	}
+	sort.Strings(candidates)
+
+	roots := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		covered := false
+		for _, root := range roots {
+			if root == "" || candidate == root || strings.HasPrefix(candidate, root+"/") {
+				covered = true
+				break
+			}
+		}
+		if false == covered {
+			roots = append(roots, candidate)
+		}
+	}
+
+	return roots
+}
+
+func (r pinRules) isEmpty() bool {
+	return len(r.paths) == 0 && len(r.patterns) == 0
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		// match zero or more directories
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], segments[0]); false == matched {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,140 @@
+package model
+
+import (
+	"time"
+
+	"github.com/burkemw3/syncthingfuse/lib/config"
+)
+
+// pullPriority orders queued pulls. Lower values are pulled first.
+type pullPriority int
+
+const (
+	pullPriorityRead pullPriority = iota
+	pullPriorityReadAhead
+	pullPriorityPin
+	pullPriorities
+)
+
+// requires lmut before entry
+func (m *Model) enqueuePullUnsafe(status *blockPullStatus, priority pullPriority) {
+	status.element = m.pullQueues[priority].PushBack(status)
+	m.lmut.Signal()
+}
+
+// reprioritizePullUnsafe raises the priority of a pull. A pull still queued
+// moves to the queue of the new priority, a pull already taken by a worker
+// stays with it, and stops waiting for the pin limit.
+// requires fmut and lmut write locks before entry
+func (m *Model) reprioritizePullUnsafe(status *blockPullStatus, priority pullPriority) {
+	if status.element != nil {
+		m.pullQueues[status.priority].Remove(status.element)
+		m.enqueuePullUnsafe(status, priority)
+	}
+	if status.priority == pullPriorityPin && status.raised != nil {
+		close(status.raised)
+	}
+	status.priority = priority
+}
+
+// isPinPull returns whether only pins ask for a pull.
+func (m *Model) isPinPull(status *blockPullStatus) bool {
+	m.lmut.L.Lock()
+	defer m.lmut.L.Unlock()
+
+	return status.priority == pullPriorityPin
+}
+
+// takePullUnsafe removes the first pull of a queue, for a worker to run.
+// requires lmut before entry
+func (m *Model) takePullUnsafe(priority pullPriority) *blockPullStatus {
+	queue := &m.pullQueues[priority]
+	status := queue.Remove(queue.Front()).(*blockPullStatus)
+	status.element = nil
+	return status
+}
+
+// setPullWorkersUnsafe starts or stops workers to match the configured
+// number.
+// requires lmut before entry
+func (m *Model) setPullWorkersUnsafe(options config.OptionsConfiguration) {
+	m.pullWorkersMaximum = options.PullWorkers
+	if m.pullWorkersMaximum < 1 {
+		m.pullWorkersMaximum = 1
+	}
+
+	for m.pullWorkers < m.pullWorkersMaximum {
+		m.pullWorkers += 1
+		go m.pullWorkerRoutine()
+	}
+
+	// surplus workers exit when they look for work
+	m.lmut.Broadcast()
+}
+
+func (m *Model) pullWorkerRoutine() {
+	for {
+		m.lmut.L.Lock()
+		status, priority, ok := m.nextPullUnsafe()
+		m.lmut.L.Unlock()
+		if !ok {
+			return
+		}
+
+		m.pullBlock(status)
+		if priority != pullPriorityPin {
+			continue
+		}
+
+		m.lmut.L.Lock()
+		m.pinPulls -= 1
+		m.lmut.Signal()
+		m.lmut.L.Unlock()
+	}
+}
+
+// nextPullUnsafe waits for the queued pull with the highest priority. Pins
+// take at most half of the workers, so reads never wait for a big pin job,
+// and wait outside the pin schedule. Pins and read-ahead stay queued while
+// the network is metered.
+// It returns false when the worker is no longer needed.
+// requires lmut before entry
+func (m *Model) nextPullUnsafe() (*blockPullStatus, pullPriority, bool) {
+	for {
+		if m.pullWorkers > m.pullWorkersMaximum {
+			m.pullWorkers -= 1
+			return nil, 0, false
+		}
+
+		metered := m.isMeteredUnsafe()
+		pinning := false == metered && m.isPinningScheduledUnsafe(time.Now())
+		for priority := pullPriorityRead; priority < pullPriorities; priority++ {
+			queue := &m.pullQueues[priority]
+			if queue.Len() == 0 {
+				continue
+			}
+			if priority == pullPriorityReadAhead && metered {
+				continue
+			}
+			if priority == pullPriorityPin && (false == pinning || m.pinPulls >= m.pinPullsMaximumUnsafe()) {
+				continue
+			}
+
+			status := m.takePullUnsafe(priority)
+			if priority == pullPriorityPin {
+				m.pinPulls += 1
+			}
+			return status, priority, true
+		}
+
+		m.lmut.Wait()
+	}
+}
+
+// requires lmut before entry
+func (m *Model) pinPullsMaximumUnsafe() int {
+	if m.pullWorkersMaximum < 2 {
+		return 1
+	}
+	return m.pullWorkersMaximum / 2
+}
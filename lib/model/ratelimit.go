@@ -0,0 +1,181 @@
+package model
+
+import (
+	"sync"
+	"time"
+
+	"github.com/burkemw3/syncthingfuse/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// rateLimiter is a token bucket of bytes. Takes beyond the tokens available
+// go into debt, which later takes wait out.
+type rateLimiter struct {
+	mut    sync.Mutex
+	rate   float64 // bytes per second, 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(kbps int) *rateLimiter {
+	rl := &rateLimiter{}
+	rl.setRate(kbps)
+	return rl
+}
+
+func (rl *rateLimiter) setRate(kbps int) {
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+
+	rate := float64(kbps) * 1024
+	if kbps < 0 {
+		rate = 0
+	}
+	if rate != rl.rate {
+		rl.rate = rate
+		rl.tokens = 0
+		rl.last = time.Now()
+	}
+}
+
+// take waits until bytes may be transferred, or skip is closed. It returns
+// false if abandon is closed first.
+func (rl *rateLimiter) take(bytes int64, abandon <-chan struct{}, skip <-chan struct{}) bool {
+	rl.mut.Lock()
+	if rl.rate == 0 {
+		rl.mut.Unlock()
+		return true
+	}
+
+	// a second worth of tokens may build up, but at least one block, so
+	// slow limits still let blocks through
+	now := time.Now()
+	burst := rl.rate
+	if burst < float64(bytes) {
+		burst = float64(bytes)
+	}
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > burst {
+		rl.tokens = burst
+	}
+	rl.last = now
+
+	rl.tokens -= float64(bytes)
+	var wait time.Duration
+	if rl.tokens < 0 {
+		wait = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.mut.Unlock()
+
+	if wait == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-skip:
+		return true
+	case <-abandon:
+		return false
+	}
+}
+
+// pullLimits are the rate limits applying to pulls.
+type pullLimits struct {
+	mut     sync.Mutex
+	all     *rateLimiter
+	pins    *rateLimiter
+	devices map[protocol.DeviceID]*rateLimiter
+}
+
+func newPullLimits() *pullLimits {
+	return &pullLimits{
+		all:     newRateLimiter(0),
+		pins:    newRateLimiter(0),
+		devices: make(map[protocol.DeviceID]*rateLimiter),
+	}
+}
+
+func (pl *pullLimits) configure(options config.OptionsConfiguration) {
+	pl.mut.Lock()
+	defer pl.mut.Unlock()
+
+	pl.all.setRate(options.MaxRecvKbps)
+	pl.pins.setRate(options.MaxPinRecvKbps)
+
+	configured := make(map[protocol.DeviceID]bool)
+	for _, limit := range options.DeviceRateLimits {
+		configured[limit.DeviceID] = true
+		if rl, ok := pl.devices[limit.DeviceID]; ok {
+			rl.setRate(limit.MaxRecvKbps)
+		} else {
+			pl.devices[limit.DeviceID] = newRateLimiter(limit.MaxRecvKbps)
+		}
+	}
+	for deviceID := range pl.devices {
+		if false == configured[deviceID] {
+			delete(pl.devices, deviceID)
+		}
+	}
+}
+
+// wait blocks until a block of the given size may be pulled from the device.
+// Pins wait for the pin limit first, unless unpinned is closed, e.g. because
+// a read needs the block. It returns false if abandon is closed first.
+func (pl *pullLimits) wait(deviceID protocol.DeviceID, bytes int64, pin bool, abandon <-chan struct{}, unpinned <-chan struct{}) bool {
+	pl.mut.Lock()
+	limiters := []*rateLimiter{pl.all}
+	if rl, ok := pl.devices[deviceID]; ok {
+		limiters = append(limiters, rl)
+	}
+	pins := pl.pins
+	pl.mut.Unlock()
+
+	if pin && false == pins.take(bytes, abandon, unpinned) {
+		return false
+	}
+	for _, rl := range limiters {
+		if false == rl.take(bytes, abandon, nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// requires lmut before entry
+func (m *Model) setPinScheduleUnsafe(options config.OptionsConfiguration) {
+	windows, err := options.GetPinSchedule()
+	if err != nil {
+		l.Warnln("Ignoring pin schedule (", options.PinSchedule, "):", err)
+		windows = nil
+	}
+	m.pinSchedule = windows
+}
+
+// requires lmut before entry
+func (m *Model) isPinningScheduledUnsafe(now time.Time) bool {
+	if len(m.pinSchedule) == 0 {
+		return true
+	}
+	for _, window := range m.pinSchedule {
+		if window.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinScheduleRoutine wakes up pull workers when a pin schedule window may
+// have opened.
+func (m *Model) pinScheduleRoutine() {
+	for range time.Tick(time.Minute) {
+		m.lmut.L.Lock()
+		if len(m.pinSchedule) > 0 {
+			m.lmut.Broadcast()
+		}
+		m.lmut.L.Unlock()
+	}
+}
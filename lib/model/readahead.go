@@ -0,0 +1,103 @@
+package model
+
+import (
+	b64 "encoding/base64"
+	"sync"
+
+	"github.com/burkemw3/syncthingfuse/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// readAheadMinimum is how far ahead reads prefetch before any pattern is
+// known, and after random access.
+const readAheadMinimum = protocol.BlockSize
+
+// ReadAhead tracks how one open file is read. While reads are sequential,
+// the window of blocks prefetched past each read doubles, up to the
+// configured maximum, and random access shrinks it again.
+type ReadAhead struct {
+	next   int64 // where the next sequential read starts
+	window int64 // bytes to prefetch past a read
+	mut    sync.Mutex
+}
+
+func NewReadAhead() *ReadAhead {
+	return &ReadAhead{
+		window: readAheadMinimum,
+	}
+}
+
+// update records a read, and returns how many bytes to prefetch past it.
+func (ra *ReadAhead) update(offset int64, size int, maximum int64) int64 {
+	ra.mut.Lock()
+	defer ra.mut.Unlock()
+
+	// the kernel issues reads in parallel, so they may arrive slightly out of
+	// order
+	distance := offset - ra.next
+	if distance < 0 {
+		distance = -distance
+	}
+	if distance <= readAheadMinimum {
+		ra.window *= 2
+	} else {
+		ra.window = readAheadMinimum
+	}
+	if ra.window > maximum {
+		ra.window = maximum
+	}
+	if ra.window < readAheadMinimum {
+		ra.window = readAheadMinimum
+	}
+
+	ra.next = offset + int64(size)
+
+	if maximum < readAheadMinimum {
+		return maximum
+	}
+	return ra.window
+}
+
+// setReadAheadLimitsUnsafe applies the configured read-ahead limits.
+// requires fmut write lock before entry (or exclusive access during init)
+func (m *Model) setReadAheadLimitsUnsafe(options config.OptionsConfiguration) {
+	maximum, inFlight, err := options.GetReadAheadLimits()
+	if err != nil {
+		l.Warnln("Ignoring read-ahead limits (", options.ReadAheadMaximum, ",", options.ReadAheadInFlight, "):", err)
+		maximum, inFlight = readAheadMinimum, readAheadMinimum
+	}
+	m.readAheadMaximum = maximum
+	m.readAheadInFlightMaximum = inFlight
+}
+
+// prefetchBlockUnsafe starts pulling a block a read will likely need soon. It
+// returns false once the bytes prefetched by all reads reach the budget, or
+// while the network is metered.
+// requires fmut and lmut write locks before entry
+func (m *Model) prefetchBlockUnsafe(folder string, file string, block protocol.BlockInfo, blockStart int64) bool {
+	if m.isMeteredUnsafe() {
+		return false
+	}
+
+	fbc := m.blockCaches[folder]
+	if fbc.HasCachedBlockData(block.Hash) || fbc.HasPinnedBlock(block.Hash) {
+		return true
+	}
+
+	hash := b64.URLEncoding.EncodeToString(block.Hash)
+	if _, ok := m.pulls[folder][hash]; ok {
+		return true
+	}
+
+	size := int64(block.Size)
+	if m.readAheadInFlight+size > m.readAheadInFlightMaximum {
+		return false
+	}
+
+	// the pull needs fmut to finish, so it sees the size
+	status := m.getOrCreatePullStatus("Prefetch", folder, file, block, blockStart, pullPriorityReadAhead)
+	status.readAheadBytes = size
+	m.readAheadInFlight += size
+
+	return true
+}
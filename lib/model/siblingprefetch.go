@@ -0,0 +1,203 @@
+package model
+
+import (
+	"path"
+	"sort"
+
+	"github.com/burkemw3/syncthingfuse/lib/config"
+	"github.com/burkemw3/syncthingfuse/lib/filetreecache"
+	"github.com/cznic/mathutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// siblingPrefetch configures warming the files following one opened in a
+// directory, e.g. the next photos while browsing.
+type siblingPrefetch struct {
+	count int   // following files to warm
+	bytes int64 // leading bytes of each
+	order string
+}
+
+// requires fmut write lock before entry (or exclusive access during init)
+func (m *Model) setSiblingPrefetchUnsafe(folderCfg config.FolderConfiguration) {
+	bytes, err := folderCfg.GetPrefetchBytes()
+	if err != nil {
+		l.Warnln("Ignoring prefetch bytes (", folderCfg.PrefetchBytes, ") for folder", folderCfg.ID, err)
+		bytes = protocol.BlockSize
+	}
+	order, err := folderCfg.GetPrefetchOrder()
+	if err != nil {
+		l.Warnln("Ignoring prefetch order (", folderCfg.PrefetchOrder, ") for folder", folderCfg.ID, err)
+		order = config.PrefetchOrderName
+	}
+
+	m.siblingPrefetch[folderCfg.ID] = siblingPrefetch{
+		count: folderCfg.PrefetchSiblings,
+		bytes: bytes,
+		order: order,
+	}
+}
+
+// siblingCache is the files of the directory last browsed in a folder, in
+// prefetch order, until the tree changes.
+type siblingCache struct {
+	tree       *filetreecache.FileTreeCache
+	generation uint64
+	dir        string
+	order      string
+	siblings   []protocol.FileInfo
+}
+
+// FileOpened records that a file was opened for reading. Once files of a
+// directory are opened one after another, the first blocks of the files
+// following the opened one are prefetched.
+func (m *Model) FileOpened(folder string, filepath string) {
+	m.fmut.RLock()
+	following := m.getFollowingSiblingsUnsafe(folder, filepath)
+	m.fmut.RUnlock()
+
+	if len(following) == 0 {
+		return
+	}
+
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+	m.lmut.L.Lock()
+	defer m.lmut.L.Unlock()
+
+	prefetch, ok := m.siblingPrefetch[folder]
+	if !ok {
+		// folder removed meanwhile
+		return
+	}
+
+	for _, sibling := range following {
+		for i, block := range sibling.Blocks {
+			blockStart := int64(i * protocol.BlockSize)
+			if blockStart >= prefetch.bytes {
+				break
+			}
+			if false == m.prefetchBlockUnsafe(folder, sibling.Name, block, blockStart) {
+				return
+			}
+		}
+	}
+}
+
+// getFollowingSiblingsUnsafe returns the files to prefetch after one was
+// opened, if files of its directory are being opened in order.
+// requires fmut read lock (or better) before entry
+func (m *Model) getFollowingSiblingsUnsafe(folder string, filepath string) []protocol.FileInfo {
+	prefetch, ok := m.siblingPrefetch[folder]
+	if !ok || prefetch.count <= 0 {
+		return nil
+	}
+
+	m.omut.Lock()
+	previous, seen := m.lastOpened[folder]
+	m.lastOpened[folder] = filepath
+	m.omut.Unlock()
+	if false == seen || path.Dir(previous) != path.Dir(filepath) {
+		return nil
+	}
+
+	siblings := m.getOrderedSiblingsUnsafe(folder, path.Dir(filepath), prefetch.order)
+	previousIndex, currentIndex := -1, -1
+	for i, sibling := range siblings {
+		switch sibling.Name {
+		case previous:
+			previousIndex = i
+		case filepath:
+			currentIndex = i
+		}
+	}
+
+	// skipping a few files, e.g. ones already looked at, is still in order
+	if previousIndex < 0 || currentIndex <= previousIndex || currentIndex-previousIndex > prefetch.count {
+		return nil
+	}
+
+	if debug {
+		l.Debugln("Files opened in order in", folder, path.Dir(filepath), "prefetching", prefetch.count, "after", filepath)
+	}
+
+	return siblings[currentIndex+1 : mathutil.Min(currentIndex+1+prefetch.count, len(siblings))]
+}
+
+// getOrderedSiblingsUnsafe returns the files in a directory, in the order
+// they are expected to be opened. The order of the directory last asked
+// about is kept until the tree changes. The result must not be modified.
+// requires fmut read lock (or better) before entry
+func (m *Model) getOrderedSiblingsUnsafe(folder string, dir string, order string) []protocol.FileInfo {
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return nil
+	}
+	generation := treeCache.Generation()
+
+	m.omut.Lock()
+	cached, ok := m.siblingCaches[folder]
+	m.omut.Unlock()
+	if ok && cached.tree == treeCache && cached.generation == generation && cached.dir == dir && cached.order == order {
+		return cached.siblings
+	}
+
+	childDir := dir
+	if childDir == "." {
+		childDir = ""
+	}
+
+	siblings := make([]protocol.FileInfo, 0)
+	for _, childPath := range treeCache.GetChildren(childDir) {
+		entry, found := treeCache.GetEntry(childPath)
+		if found && false == entry.IsDirectory() && false == entry.IsSymlink() {
+			siblings = append(siblings, entry)
+		}
+	}
+
+	sort.Sort(siblingOrder{entries: siblings, order: order})
+
+	m.omut.Lock()
+	m.siblingCaches[folder] = &siblingCache{
+		tree:       treeCache,
+		generation: generation,
+		dir:        dir,
+		order:      order,
+		siblings:   siblings,
+	}
+	m.omut.Unlock()
+
+	return siblings
+}
+
+// siblingOrder sorts files by the configured prefetch order, then by name.
+type siblingOrder struct {
+	entries []protocol.FileInfo
+	order   string
+}
+
+func (so siblingOrder) Len() int {
+	return len(so.entries)
+}
+
+func (so siblingOrder) Swap(i, j int) {
+	so.entries[i], so.entries[j] = so.entries[j], so.entries[i]
+}
+
+func (so siblingOrder) Less(i, j int) bool {
+	a, b := so.entries[i], so.entries[j]
+	switch so.order {
+	case config.PrefetchOrderSize:
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case config.PrefetchOrderMtime:
+		if a.ModifiedS != b.ModifiedS {
+			return a.ModifiedS < b.ModifiedS
+		}
+		if a.ModifiedNs != b.ModifiedNs {
+			return a.ModifiedNs < b.ModifiedNs
+		}
+	}
+	return a.Name < b.Name
+}
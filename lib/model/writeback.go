@@ -0,0 +1,666 @@
+package model
+
+import (
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/burkemw3/syncthingfuse/lib/config"
+	"github.com/burkemw3/syncthingfuse/lib/fileblockcache"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrFileExists        = errors.New("file exists")
+	ErrDirectoryNotEmpty = errors.New("directory not empty")
+	ErrIsDirectory       = errors.New("is a directory")
+	ErrNotStoredLocally  = errors.New("not stored locally")
+)
+
+// stagedFile is a file opened for writing through the mount. Its contents
+// live in the write-back area until the last handle is released.
+type stagedFile struct {
+	diskPath    string
+	permissions uint32
+	handles     int
+	dirty       bool
+	generation  int // counts changes, so commits notice writes made while hashing
+}
+
+// requires fmut write lock before entry
+func (staged *stagedFile) changed() {
+	staged.dirty = true
+	staged.generation += 1
+}
+
+func getWriteBackBasePath(cfg *config.Wrapper, folder string) string {
+	return path.Join(fileblockcache.GetDiskCacheBasePath(cfg, folder), "writeback")
+}
+
+func getWriteBackPath(cfg *config.Wrapper, folder string, filepath string) string {
+	pathHash := sha256.Sum256([]byte(filepath))
+	return path.Join(getWriteBackBasePath(cfg, folder), b64.URLEncoding.EncodeToString(pathHash[:]))
+}
+
+// resetWriteBackArea discards anything left over from a previous run. Writes
+// are only announced once a file is released, so leftovers are incomplete.
+func (m *Model) resetWriteBackArea(folder string) {
+	writeBackFolder := getWriteBackBasePath(m.cfg, folder)
+	os.RemoveAll(writeBackFolder)
+	err := os.MkdirAll(writeBackFolder, 0744)
+	if err != nil {
+		l.Warnln("Cannot create write-back area for folder", folder, err)
+	}
+}
+
+// CreateFile creates a new, empty file and opens it for writing.
+func (m *Model) CreateFile(folder string, filepath string) error {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return protocol.ErrNoSuchFile
+	}
+	if _, found := treeCache.GetEntry(filepath); found {
+		return ErrFileExists
+	}
+
+	diskPath := getWriteBackPath(m.cfg, folder, filepath)
+	err := ioutil.WriteFile(diskPath, []byte{}, 0644)
+	if err != nil {
+		l.Warnln("Cannot stage new file", folder, filepath, err)
+		return err
+	}
+
+	m.staged[folder][filepath] = &stagedFile{
+		diskPath:    diskPath,
+		permissions: 0644,
+		handles:     1,
+	}
+
+	// announce right away, so the file is visible while being written
+	m.replaceLocalEntryUnsafe(folder, stagedEntry(filepath, 0644, nil, 0))
+
+	return nil
+}
+
+// OpenFileForWrite stages an existing file for writing, fetching its current
+// contents unless it is truncated. Every successful call must be paired with
+// a call to ReleaseFile.
+func (m *Model) OpenFileForWrite(ctx context.Context, folder string, filepath string, truncate bool) error {
+	m.fmut.Lock()
+	if staged, ok := m.staged[folder][filepath]; ok {
+		defer m.fmut.Unlock()
+		staged.handles += 1
+		if truncate {
+			staged.changed()
+			return os.Truncate(staged.diskPath, 0)
+		}
+		return nil
+	}
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		m.fmut.Unlock()
+		return protocol.ErrNoSuchFile
+	}
+	entry, found := treeCache.GetEntry(filepath)
+	m.fmut.Unlock()
+	if false == found {
+		return protocol.ErrNoSuchFile
+	}
+	if entry.IsDirectory() {
+		return ErrIsDirectory
+	}
+
+	// fill the staged copy without holding locks, since reads may pull
+	fd, err := ioutil.TempFile(getWriteBackBasePath(m.cfg, folder), "fill")
+	if err != nil {
+		return err
+	}
+	if false == truncate {
+		for offset := int64(0); offset < entry.Size; offset += protocol.BlockSize {
+			size := protocol.BlockSize
+			if entry.Size-offset < int64(size) {
+				size = int(entry.Size - offset)
+			}
+			data, err := m.GetFileData(ctx, folder, filepath, offset, size)
+			if err == nil {
+				_, err = fd.WriteAt(data, offset)
+			}
+			if err != nil {
+				fd.Close()
+				os.Remove(fd.Name())
+				return err
+			}
+		}
+	}
+	fd.Close()
+
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	if staged, ok := m.staged[folder][filepath]; ok {
+		// someone else staged it while we were filling
+		os.Remove(fd.Name())
+		staged.handles += 1
+		if truncate {
+			staged.changed()
+			return os.Truncate(staged.diskPath, 0)
+		}
+		return nil
+	}
+
+	diskPath := getWriteBackPath(m.cfg, folder, filepath)
+	err = os.Rename(fd.Name(), diskPath)
+	if err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+
+	permissions := entry.Permissions
+	if entry.NoPermissions || permissions == 0 {
+		permissions = 0644
+	}
+	m.staged[folder][filepath] = &stagedFile{
+		diskPath:    diskPath,
+		permissions: permissions,
+		handles:     1,
+		dirty:       truncate && entry.Size > 0,
+	}
+
+	return nil
+}
+
+// WriteFileData writes to a file previously opened for writing.
+func (m *Model) WriteFileData(folder string, filepath string, offset int64, data []byte) (int, error) {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	staged, ok := m.staged[folder][filepath]
+	if !ok {
+		return 0, protocol.ErrNoSuchFile
+	}
+
+	fd, err := os.OpenFile(staged.diskPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	n, err := fd.WriteAt(data, offset)
+	if n > 0 {
+		staged.changed()
+	}
+
+	return n, err
+}
+
+// TruncateFile changes the size of a file, announcing the new version.
+func (m *Model) TruncateFile(ctx context.Context, folder string, filepath string, size int64) error {
+	err := m.OpenFileForWrite(ctx, folder, filepath, size == 0)
+	if err != nil {
+		return err
+	}
+
+	m.fmut.Lock()
+	staged := m.staged[folder][filepath]
+	err = os.Truncate(staged.diskPath, size)
+	if err == nil {
+		staged.changed()
+	}
+	m.fmut.Unlock()
+
+	releaseErr := m.ReleaseFile(folder, filepath)
+	if err != nil {
+		return err
+	}
+	return releaseErr
+}
+
+// FlushFile announces anything written to a file so far.
+func (m *Model) FlushFile(folder string, filepath string) error {
+	return m.commitStagedFile(folder, filepath)
+}
+
+// ReleaseFile closes one handle on a file opened for writing, announcing any
+// changes. The staged copy is discarded once the last handle is released.
+func (m *Model) ReleaseFile(folder string, filepath string) error {
+	err := m.commitStagedFile(folder, filepath)
+
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	staged, ok := m.staged[folder][filepath]
+	if !ok {
+		return err
+	}
+
+	staged.handles -= 1
+	if staged.handles <= 0 {
+		os.Remove(staged.diskPath)
+		delete(m.staged[folder], filepath)
+	}
+
+	return err
+}
+
+// MakeDirectory creates a new, empty directory.
+func (m *Model) MakeDirectory(folder string, dirpath string) error {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return protocol.ErrNoSuchFile
+	}
+	if _, found := treeCache.GetEntry(dirpath); found {
+		return ErrFileExists
+	}
+
+	now := time.Now()
+	entry := protocol.FileInfo{
+		Name:        dirpath,
+		Type:        protocol.FileInfoTypeDirectory,
+		Permissions: 0755,
+		ModifiedS:   now.Unix(),
+		ModifiedNs:  int32(now.Nanosecond()),
+	}
+	m.replaceLocalEntryUnsafe(folder, entry)
+
+	return nil
+}
+
+// Remove deletes a file or an empty directory.
+func (m *Model) Remove(folder string, filepath string) error {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return protocol.ErrNoSuchFile
+	}
+	entry, found := treeCache.GetEntry(filepath)
+	if false == found {
+		return protocol.ErrNoSuchFile
+	}
+	if entry.IsDirectory() && len(treeCache.GetChildren(filepath)) > 0 {
+		return ErrDirectoryNotEmpty
+	}
+
+	m.deleteLocalEntryUnsafe(folder, filepath, true)
+
+	return nil
+}
+
+// Rename moves a file or directory within a folder, replacing any file or
+// empty directory at the destination. Files not stored locally cannot be
+// moved, since no peer would then have them under the new name, so they are
+// left for the caller to copy.
+func (m *Model) Rename(folder string, from string, to string) error {
+	// announce what was written, so the moved entries have it
+	for _, filepath := range m.getStagedBelow(folder, from) {
+		if err := m.commitStagedFile(folder, filepath); err != nil {
+			return err
+		}
+	}
+
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	treeCache, ok := m.treeCaches[folder]
+	if !ok {
+		return protocol.ErrNoSuchFile
+	}
+	entry, found := treeCache.GetEntry(from)
+	if false == found {
+		return protocol.ErrNoSuchFile
+	}
+	if false == m.isStoredLocallyUnsafe(folder, entry) {
+		return ErrNotStoredLocally
+	}
+	if existing, found := treeCache.GetEntry(to); found {
+		if existing.IsDirectory() && len(treeCache.GetChildren(to)) > 0 {
+			return ErrDirectoryNotEmpty
+		}
+		m.deleteLocalEntryUnsafe(folder, to, true)
+	}
+
+	if err := m.moveStagedUnsafe(folder, from, to); err != nil {
+		return err
+	}
+
+	m.renameLocalEntryUnsafe(folder, entry, to)
+	m.deleteLocalEntryUnsafe(folder, from, false)
+
+	return nil
+}
+
+// getStagedBelow returns the staged files at or below a path.
+func (m *Model) getStagedBelow(folder string, filepath string) []string {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	files := make([]string, 0)
+	for staged := range m.staged[folder] {
+		if isAtOrBelow(staged, filepath) {
+			files = append(files, staged)
+		}
+	}
+	return files
+}
+
+func isAtOrBelow(filepath string, dir string) bool {
+	return filepath == dir || strings.HasPrefix(filepath, dir+"/")
+}
+
+// isStoredLocallyUnsafe returns whether every block of a file, or of every
+// file below a directory, is cached, pinned or staged.
+// requires fmut read lock (or better) before entry
+func (m *Model) isStoredLocallyUnsafe(folder string, entry protocol.FileInfo) bool {
+	treeCache := m.treeCaches[folder]
+	fbc := m.blockCaches[folder]
+
+	if entry.IsDirectory() {
+		for _, child := range treeCache.GetChildren(entry.Name) {
+			childEntry, found := treeCache.GetEntry(child)
+			if found && false == m.isStoredLocallyUnsafe(folder, childEntry) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if _, ok := m.staged[folder][entry.Name]; ok {
+		return true
+	}
+	for _, block := range entry.Blocks {
+		if false == fbc.HasPinnedBlock(block.Hash) && false == fbc.HasCachedBlockData(block.Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// moveStagedUnsafe moves the staged files at or below a path along with a
+// rename, so writes still open keep going to the renamed files. The staged
+// copies live at paths derived from the file names, where new files of the
+// old names would be staged.
+// requires fmut write lock before entry
+func (m *Model) moveStagedUnsafe(folder string, from string, to string) error {
+	moved := make(map[string]string) // old name -> new name
+	for filepath, staged := range m.staged[folder] {
+		if false == isAtOrBelow(filepath, from) {
+			continue
+		}
+
+		renamed := to + strings.TrimPrefix(filepath, from)
+		diskPath := getWriteBackPath(m.cfg, folder, renamed)
+		if err := os.Rename(staged.diskPath, diskPath); err != nil {
+			l.Warnln("Cannot move staged file", folder, filepath, renamed, err)
+			// put back what was moved, leaving both names as they were
+			for filepath, renamed := range moved {
+				os.Rename(getWriteBackPath(m.cfg, folder, renamed), m.staged[folder][filepath].diskPath)
+			}
+			return err
+		}
+		moved[filepath] = renamed
+	}
+
+	for filepath, renamed := range moved {
+		staged := m.staged[folder][filepath]
+		staged.diskPath = getWriteBackPath(m.cfg, folder, renamed)
+		// committing pins what was staged, since the moved entry may only
+		// refer to cached blocks
+		staged.changed()
+		delete(m.staged[folder], filepath)
+		m.staged[folder][renamed] = staged
+	}
+
+	return nil
+}
+
+// renameLocalEntryUnsafe announces an entry, and everything below a
+// directory, under a new name. The blocks stay where they are, cached or
+// pinned.
+// requires fmut write lock before entry
+func (m *Model) renameLocalEntryUnsafe(folder string, entry protocol.FileInfo, to string) {
+	treeCache := m.treeCaches[folder]
+
+	children := make([]string, 0)
+	if entry.IsDirectory() {
+		children = treeCache.GetChildren(entry.Name)
+	}
+
+	moved := entry
+	moved.Name = to
+	m.replaceLocalEntryUnsafe(folder, moved)
+
+	for _, child := range children {
+		childEntry, found := treeCache.GetEntry(child)
+		if found {
+			m.renameLocalEntryUnsafe(folder, childEntry, path.Join(to, path.Base(child)))
+		}
+	}
+}
+
+// commitStagedFile announces what was written to a staged file. The file
+// is hashed without holding fmut, so reads and pulls go on meanwhile. Writes
+// made while hashing leave the file dirty, for the next commit.
+func (m *Model) commitStagedFile(folder string, filepath string) error {
+	m.fmut.Lock()
+	staged, ok := m.staged[folder][filepath]
+	if !ok || false == staged.dirty {
+		m.fmut.Unlock()
+		return nil
+	}
+	generation := staged.generation
+	permissions := staged.permissions
+	fd, err := os.Open(staged.diskPath)
+	m.fmut.Unlock()
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	blocks, size, err := m.pinStagedBlocks(folder, filepath, fd)
+	if err != nil {
+		return err
+	}
+
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	if m.staged[folder][filepath] != staged {
+		// removed or renamed meanwhile
+		return nil
+	}
+	m.replaceLocalEntryUnsafe(folder, stagedEntry(filepath, permissions, blocks, size))
+	if staged.generation == generation {
+		staged.dirty = false
+	}
+
+	return nil
+}
+
+// pinStagedBlocks hashes a staged file, and pins its blocks. It only takes
+// fmut to pin each block.
+func (m *Model) pinStagedBlocks(folder string, filepath string, fd *os.File) ([]protocol.BlockInfo, int64, error) {
+	blocks := make([]protocol.BlockInfo, 0)
+	size := int64(0)
+	buf := make([]byte, protocol.BlockSize)
+	for {
+		n, err := io.ReadFull(fd, buf)
+		if n > 0 {
+			data := buf[:n]
+			hash := sha256.Sum256(data)
+			block := protocol.BlockInfo{
+				Offset: size,
+				Size:   int32(n),
+				Hash:   hash[:],
+			}
+
+			m.fmut.Lock()
+			if fbc, ok := m.blockCaches[folder]; ok && false == fbc.HasPinnedBlock(block.Hash) {
+				fbc.PinNewBlock(block, data)
+			}
+			m.fmut.Unlock()
+
+			blocks = append(blocks, block)
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			l.Warnln("Cannot read staged file", folder, filepath, err)
+			return nil, 0, err
+		}
+	}
+
+	return blocks, size, nil
+}
+
+func stagedEntry(filepath string, permissions uint32, blocks []protocol.BlockInfo, size int64) protocol.FileInfo {
+	now := time.Now()
+	return protocol.FileInfo{
+		Name:        filepath,
+		Type:        protocol.FileInfoTypeFile,
+		Size:        size,
+		Permissions: permissions,
+		ModifiedS:   now.Unix(),
+		ModifiedNs:  int32(now.Nanosecond()),
+		Blocks:      blocks,
+	}
+}
+
+// replaceLocalEntryUnsafe records a change made through the mount as a new
+// version authored by this device, and announces it to peers.
+// requires fmut write lock before entry
+func (m *Model) replaceLocalEntryUnsafe(folder string, entry protocol.FileInfo) {
+	treeCache := m.treeCaches[folder]
+
+	if old, found := treeCache.GetEntry(entry.Name); found {
+		entry.Version = old.Version.Update(m.myID.Short())
+		m.releaseLocalBlocksUnsafe(folder, old, entry.Blocks)
+		treeCache.RemoveEntry(entry.Name)
+	} else if deleted, found := treeCache.GetDeletedEntry(entry.Name); found {
+		entry.Version = deleted.Version.Update(m.myID.Short())
+	} else {
+		entry.Version = protocol.Vector{}.Update(m.myID.Short())
+	}
+
+	if debug {
+		l.Debugln("model: local change to", folder, entry.Name, "version", entry.Version)
+	}
+
+	treeCache.AddEntry(entry, m.myID)
+
+	m.pmut.RLock()
+	m.markIndexChanged(folder, entry.Name)
+	m.pmut.RUnlock()
+}
+
+// deleteLocalEntryUnsafe records a deletion made through the mount, including
+// everything below a directory, and announces it to peers.
+// requires fmut write lock before entry
+func (m *Model) deleteLocalEntryUnsafe(folder string, filepath string, releaseBlocks bool) {
+	treeCache := m.treeCaches[folder]
+
+	entry, found := treeCache.GetEntry(filepath)
+	if false == found {
+		return
+	}
+
+	if entry.IsDirectory() {
+		for _, child := range treeCache.GetChildren(filepath) {
+			m.deleteLocalEntryUnsafe(folder, child, releaseBlocks)
+		}
+	}
+
+	if releaseBlocks {
+		m.releaseLocalBlocksUnsafe(folder, entry, nil)
+	}
+
+	if staged, ok := m.staged[folder][filepath]; ok {
+		os.Remove(staged.diskPath)
+		delete(m.staged[folder], filepath)
+	}
+
+	now := time.Now()
+	tombstone := protocol.FileInfo{
+		Name:       filepath,
+		Type:       entry.Type,
+		Deleted:    true,
+		ModifiedS:  now.Unix(),
+		ModifiedNs: int32(now.Nanosecond()),
+		Version:    entry.Version.Update(m.myID.Short()),
+	}
+
+	if debug {
+		l.Debugln("model: local deletion of", folder, filepath, "version", tombstone.Version)
+	}
+
+	treeCache.RemoveEntry(filepath)
+	treeCache.AddDeletedEntry(tombstone)
+
+	m.pmut.RLock()
+	m.markIndexChanged(folder, filepath)
+	m.pmut.RUnlock()
+}
+
+// releaseLocalBlocksUnsafe unpins the blocks of a locally authored version
+// that are no longer needed, once it has been replaced.
+// requires fmut write lock before entry
+func (m *Model) releaseLocalBlocksUnsafe(folder string, old protocol.FileInfo, keep []protocol.BlockInfo) {
+	if false == m.isLocallyAuthored(folder, old.Name) || m.isFilePinned(folder, old.Name) {
+		return
+	}
+
+	kept := make(map[string]bool)
+	for _, block := range keep {
+		kept[string(block.Hash)] = true
+	}
+
+	for _, block := range old.Blocks {
+		if false == kept[string(block.Hash)] {
+			m.blockCaches[folder].UnpinBlock(block.Hash)
+		}
+	}
+}
+
+// requires fmut read (or better) lock before entry
+func (m *Model) isLocallyAuthored(folder string, filepath string) bool {
+	devices, _ := m.treeCaches[folder].GetEntryDevices(filepath)
+	for _, device := range devices {
+		if device.Equals(m.myID) {
+			return true
+		}
+	}
+	return false
+}
+
+// requires fmut read (or better) lock before entry
+func (m *Model) readStagedFileData(staged *stagedFile, readStart int64, readSize int) ([]byte, error) {
+	fd, err := os.Open(staged.diskPath)
+	if err != nil {
+		return []byte(""), err
+	}
+	defer fd.Close()
+
+	data := make([]byte, readSize)
+	n, err := fd.ReadAt(data, readStart)
+	if err != nil && err != io.EOF {
+		return []byte(""), err
+	}
+
+	return data[:n], nil
+}